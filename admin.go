@@ -0,0 +1,215 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"runtime"
+	"strconv"
+	"time"
+)
+
+// How often the admin metrics stream sends a sample.
+const metricsPeriod = time.Second
+
+// MetricsSample is one frame of the admin metrics stream.
+type MetricsSample struct {
+	Type           string  `json:"type"`
+	Timestamp      int64   `json:"ts"`
+	Clients        int64   `json:"clients"`
+	MessagesPerSec float64 `json:"messages_per_sec"`
+	Tenants        int     `json:"tenants"`
+	Goroutines     int     `json:"goroutines"`
+}
+
+// ClientInfo describes a connected client in /api/clients.
+type ClientInfo struct {
+	Name      string `json:"name"`
+	TenantID  string `json:"tenant_id"`
+	Tier      string `json:"tier"`
+	Anonymous bool   `json:"anonymous"`
+
+	// Unix time the connection was established.
+	ConnectedSince int64 `json:"connected_since"`
+
+	// Exponential moving average of the client's messages per second.
+	EMARate float64 `json:"ema_rate"`
+
+	// ID of the token the client authenticated with, to match it against
+	// /api/me requests. Not shown to admins.
+	jti string
+}
+
+// isAdmin reports whether the request carries the admin token as a Bearer
+// token.
+func isAdmin(r *http.Request) bool {
+	token, _ := bearerToken(r)
+	return isAdminToken(token)
+}
+
+// isAdminToken reports whether token is the admin token. Admin endpoints are
+// disabled when no admin token is configured.
+func isAdminToken(token string) bool {
+	if *adminToken == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(*adminToken)) == 1
+}
+
+// adminTenant returns the tenant named by the request's X-Tenant-ID header,
+// and whether the header is present.
+func adminTenant(r *http.Request) (string, bool) {
+	ids, ok := r.Header[http.CanonicalHeaderKey(tenantIDHeader)]
+	if !ok {
+		return "", false
+	}
+	return ids[0], true
+}
+
+// serveAdminWs streams server metrics to an admin observer once per second.
+// The stream is one-way: anything the observer sends is discarded.
+func serveAdminWs(tenants *TenantHub, w http.ResponseWriter, r *http.Request) {
+	reqID := requestID(r.Context())
+
+	// Browsers cannot set headers on a WebSocket, so the stream also takes
+	// the admin token from the query. The other admin endpoints do not, to
+	// keep it out of their access logs.
+	token, ok := bearerToken(r)
+	if !ok {
+		token = r.URL.Query().Get("token")
+	}
+	if !isAdminToken(token) {
+		log.Printf("request_id=%s Admin authentication failed", reqID)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	conn, err := upgrader.Upgrade(w, r, http.Header{requestIDHeader: {reqID}, protocolVersionHeader: {ProtocolVersion}})
+	if err != nil {
+		log.Printf("request_id=%s %v", reqID, err)
+		return
+	}
+	defer conn.Close()
+
+	// Read and drop incoming messages so control frames are processed and
+	// we notice when the observer goes away.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(metricsPeriod)
+	defer ticker.Stop()
+	_, lastMessages, _ := tenants.stats()
+	last := time.Now()
+	for {
+		select {
+		case now := <-ticker.C:
+			clients, messages, numTenants := tenants.stats()
+			sample := MetricsSample{
+				Type:           "metrics",
+				Timestamp:      now.UnixMilli(),
+				Clients:        clients,
+				MessagesPerSec: float64(messages-lastMessages) / now.Sub(last).Seconds(),
+				Tenants:        numTenants,
+				Goroutines:     runtime.NumGoroutine(),
+			}
+			lastMessages, last = messages, now
+
+			conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := conn.WriteJSON(sample); err != nil {
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// handleListClients lists the connected clients of the tenant named in the
+// X-Tenant-ID header.
+func handleListClients(tenants *TenantHub, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Method not allowed"})
+		return
+	}
+	if !isAdmin(r) {
+		log.Printf("request_id=%s Admin authentication failed", requestID(r.Context()))
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Unauthorized"})
+		return
+	}
+
+	tenantID, ok := adminTenant(r)
+	if !ok {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Missing X-Tenant-ID header"})
+		return
+	}
+
+	infos := tenants.clientsOf(tenantID)
+	if infos == nil {
+		infos = []ClientInfo{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(infos)
+}
+
+// handleMute mutes a client for duration_seconds, or unmutes it when that is
+// 0. A muted client stays connected and keeps receiving messages, but
+// everything it sends is rejected with ERROR:muted.
+func handleMute(tenants *TenantHub, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Method not allowed"})
+		return
+	}
+	if !isAdmin(r) {
+		log.Printf("request_id=%s Admin authentication failed", requestID(r.Context()))
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Unauthorized"})
+		return
+	}
+
+	tenantID, ok := adminTenant(r)
+	if !ok {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Missing X-Tenant-ID header"})
+		return
+	}
+
+	seconds, err := strconv.Atoi(r.FormValue("duration_seconds"))
+	if err != nil || seconds < 0 {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Invalid duration_seconds"})
+		return
+	}
+	var until time.Time
+	if seconds > 0 {
+		until = time.Now().Add(time.Duration(seconds) * time.Second)
+	}
+
+	name := r.FormValue("name")
+	if !tenants.mute(tenantID, name, until) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Client not found"})
+		return
+	}
+	log.Printf("request_id=%s Muted %s for %ds", requestID(r.Context()), name, seconds)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestAdminTokenInQueryOnlyForStream(t *testing.T) {
+	*adminToken = "secret"
+	defer func() { *adminToken = "" }()
+	tenants := newTenantHub()
+
+	rec := httptest.NewRecorder()
+	handleListClients(tenants, rec, httptest.NewRequest("GET", "/api/clients?token=secret", nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("/api/clients with ?token: status = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+
+	r := httptest.NewRequest("GET", "/api/clients", nil)
+	r.Header.Set("Authorization", "Bearer secret")
+	r.Header.Set(tenantIDHeader, "")
+	rec = httptest.NewRecorder()
+	handleListClients(tenants, rec, r)
+	if rec.Code != http.StatusOK {
+		t.Errorf("/api/clients with Bearer: status = %d, want %d", rec.Code, http.StatusOK)
+	}
+
+	// Without an upgrade the stream fails after authentication, with 400.
+	rec = httptest.NewRecorder()
+	serveAdminWs(tenants, rec, httptest.NewRequest("GET", "/admin/ws?token=secret", nil))
+	if rec.Code == http.StatusUnauthorized {
+		t.Error("/admin/ws rejected ?token")
+	}
+}
+
+// adminRequest calls the admin handler for path with the admin token, the
+// tenant in X-Tenant-ID, unless it is "-", and form as the body.
+func adminRequest(tenants *TenantHub, method, path, tenantID string, form url.Values) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("Authorization", "Bearer "+*adminToken)
+	if tenantID != "-" {
+		r.Header.Set(tenantIDHeader, tenantID)
+	}
+	rec := httptest.NewRecorder()
+	if path == "/api/clients" {
+		handleListClients(tenants, rec, r)
+	} else {
+		handleMute(tenants, rec, r)
+	}
+	return rec
+}
+
+func TestMuteIsScopedByTenantHeader(t *testing.T) {
+	*adminToken = "secret"
+	defer func() { *adminToken = "" }()
+	srv, tenants := newTestServer(t)
+	acme := dialTest(t, srv, newTestToken(t, "guest-a", "acme"))
+	dialTest(t, srv, newTestToken(t, "guest-b", "globex"))
+
+	rec := adminRequest(tenants, "GET", "/api/clients", "acme", nil)
+	var infos []ClientInfo
+	json.NewDecoder(rec.Body).Decode(&infos)
+	if len(infos) != 1 || infos[0].Name != "guest-a" || infos[0].TenantID != "acme" {
+		t.Errorf("clients of acme = %+v, want guest-a only", infos)
+	}
+	if rec := adminRequest(tenants, "GET", "/api/clients", "-", nil); rec.Code != http.StatusBadRequest {
+		t.Errorf("clients without %s: status = %d, want %d", tenantIDHeader, rec.Code, http.StatusBadRequest)
+	}
+
+	mute := url.Values{"name": {"guest-a"}, "duration_seconds": {"60"}}
+	if rec := adminRequest(tenants, "POST", "/api/clients/mute", "globex", mute); rec.Code != http.StatusNotFound {
+		t.Errorf("mute in other tenant: status = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+	if rec := adminRequest(tenants, "POST", "/api/clients/mute", "acme", mute); rec.Code != http.StatusNoContent {
+		t.Fatalf("mute: status = %d, want %d", rec.Code, http.StatusNoContent)
+	}
+	notice := readText(t, acme)
+	if !strings.HasPrefix(notice, mutedPrefix) {
+		t.Fatalf("notice = %q, want %s", notice, mutedPrefix)
+	}
+
+	if err := acme.WriteMessage(websocket.TextMessage, []byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	reply := readText(t, acme)
+	until, err := strconv.ParseInt(strings.TrimPrefix(reply, errorPrefix+"muted:"), 10, 64)
+	if err != nil || until <= time.Now().Unix() {
+		t.Fatalf("reply = %q, want %smuted:<end of the mute>", reply, errorPrefix)
+	}
+	if notice != mutedPrefix+strconv.FormatInt(until, 10) {
+		t.Errorf("notice = %q and reply = %q disagree on the end of the mute", notice, reply)
+	}
+}
+
+func TestAdminMetricsStream(t *testing.T) {
+	*adminToken = "secret"
+	defer func() { *adminToken = "" }()
+	srv, _ := newTestServer(t)
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/admin/ws?token=secret", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	var lastTS float64
+	for i := range 3 {
+		conn.SetReadDeadline(time.Now().Add(2 * metricsPeriod))
+		var sample map[string]any
+		if err := conn.ReadJSON(&sample); err != nil {
+			t.Fatal(err)
+		}
+		for _, field := range []string{"type", "ts", "clients", "messages_per_sec", "tenants", "goroutines"} {
+			if _, ok := sample[field]; !ok {
+				t.Errorf("frame %d lacks %s: %v", i, field, sample)
+			}
+		}
+		ts, _ := sample["ts"].(float64)
+		if ts <= lastTS {
+			t.Errorf("frame %d ts = %v, want after %v", i, ts, lastTS)
+		}
+		lastTS = ts
+	}
+}
+
+func TestStatsKeepMessagesOfStoppedHubs(t *testing.T) {
+	srv, tenants := newTestServer(t)
+	a := dialTest(t, srv, newTestToken(t, "guest-a", "acme"))
+	if err := a.WriteMessage(websocket.TextMessage, []byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		if _, messages, _ := tenants.stats(); messages == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("message not counted")
+		}
+	}
+
+	a.Close()
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		_, messages, numTenants := tenants.stats()
+		if numTenants == 0 {
+			if messages != 1 {
+				t.Errorf("messages after the hub stopped = %d, want 1", messages)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("hub not stopped")
+		}
+	}
+}
+
+// chatReply sends text from conn and returns the reply the sender gets.
+func chatReply(t *testing.T, conn *websocket.Conn, text string) string {
+	t.Helper()
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(text)); err != nil {
+		t.Fatal(err)
+	}
+	return readText(t, conn)
+}
+
+func TestMuteSurvivesReconnect(t *testing.T) {
+	*adminToken = "secret"
+	defer func() { *adminToken = "" }()
+	srv, tenants := newTestServer(t)
+	token := newTestToken(t, "guest-a", "")
+	conn := dialTest(t, srv, token)
+	dialTest(t, srv, newTestToken(t, "guest-b", "")) // keeps the hub running
+
+	mute := url.Values{"name": {"guest-a"}, "duration_seconds": {"60"}}
+	if rec := adminRequest(tenants, "POST", "/api/clients/mute", "", mute); rec.Code != http.StatusNoContent {
+		t.Fatalf("mute: status = %d, want %d", rec.Code, http.StatusNoContent)
+	}
+	conn.Close()
+
+	conn = dialTest(t, srv, token)
+	if notice := readText(t, conn); !strings.HasPrefix(notice, mutedPrefix) || notice == mutedPrefix+"0" {
+		t.Errorf("notice on reconnect = %q, want %s<unix_time>", notice, mutedPrefix)
+	}
+	if reply := chatReply(t, conn, "hi"); !strings.HasPrefix(reply, errorPrefix+"muted:") {
+		t.Errorf("reply after reconnect = %q, want %smuted:", reply, errorPrefix)
+	}
+}
+
+func TestMuteExpiresAndCanBeLifted(t *testing.T) {
+	*adminToken = "secret"
+	defer func() { *adminToken = "" }()
+	srv, tenants := newTestServer(t)
+	conn := dialTest(t, srv, newTestToken(t, "guest-a", ""))
+	peer := dialTest(t, srv, newTestToken(t, "guest-b", ""))
+	delivered := func() bool {
+		t.Helper()
+		if err := conn.WriteMessage(websocket.TextMessage, []byte("hi")); err != nil {
+			t.Fatal(err)
+		}
+		return readText(t, peer) == "guest-a: hi"
+	}
+
+	mute := url.Values{"name": {"guest-a"}, "duration_seconds": {"1"}}
+	adminRequest(tenants, "POST", "/api/clients/mute", "", mute)
+	readText(t, conn)
+	if reply := chatReply(t, conn, "hi"); !strings.HasPrefix(reply, errorPrefix+"muted:") {
+		t.Fatalf("reply while muted = %q, want %smuted:", reply, errorPrefix)
+	}
+	time.Sleep(time.Second)
+	if !delivered() {
+		t.Error("message not delivered after the mute expired")
+	}
+
+	mute.Set("duration_seconds", "60")
+	adminRequest(tenants, "POST", "/api/clients/mute", "", mute)
+	readText(t, conn)
+	mute.Set("duration_seconds", "0")
+	adminRequest(tenants, "POST", "/api/clients/mute", "", mute)
+	if notice := readText(t, conn); notice != mutedPrefix+"0" {
+		t.Errorf("notice on unmute = %q, want %s0", notice, mutedPrefix)
+	}
+	if !delivered() {
+		t.Error("message not delivered after unmute")
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestAnonymousClientsListenOnly(t *testing.T) {
+	*allowAnonymous = true
+	defer func() { *allowAnonymous = false }()
+	srv, _ := newTestServer(t)
+	anon := dialTest(t, srv, "")
+	if got := readText(t, anon); !strings.HasPrefix(got, "IDENTITY:anon-") {
+		t.Fatalf("first message = %q, want IDENTITY:anon-", got)
+	}
+	guest := dialTest(t, srv, newTestToken(t, "guest-a", ""))
+
+	if err := guest.WriteMessage(websocket.TextMessage, []byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	if got := readText(t, anon); got != "guest-a: hi" {
+		t.Errorf("anonymous client got %q, want %q", got, "guest-a: hi")
+	}
+	if reply := chatReply(t, anon, "hello"); reply != errorPrefix+"authentication_required" {
+		t.Errorf("reply to anonymous message = %q, want %sauthentication_required", reply, errorPrefix)
+	}
+}
+
+func TestAnonymousClientsAreCapped(t *testing.T) {
+	*allowAnonymous = true
+	defer func() { *allowAnonymous = false }()
+	srv, _ := newTestServer(t)
+	for range maxAnonymousClients {
+		readText(t, dialTest(t, srv, ""))
+	}
+	if code := readCloseCode(t, dialTest(t, srv, ""), time.Second); code != closeAnonymousLimit {
+		t.Errorf("close code = %d, want %d", code, closeAnonymousLimit)
+	}
+}
+
+func TestAnonymousClientsObeyAllowedTenants(t *testing.T) {
+	*allowAnonymous = true
+	claimsValidator = TenantValidator{allowedTenants: []string{"acme"}}
+	defer func() {
+		*allowAnonymous = false
+		claimsValidator = NoOpValidator{}
+	}()
+	srv, _ := newTestServer(t)
+
+	_, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws", nil)
+	if err == nil {
+		t.Fatal("anonymous connection to a disallowed default tenant accepted")
+	}
+	if resp == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("response = %v, want %d", resp, http.StatusUnauthorized)
+	}
+}
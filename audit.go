@@ -0,0 +1,58 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+// auditLog receives one JSON object per line, without the standard logger's
+// prefix so that the entries can be parsed as they are.
+var auditLog = log.New(os.Stderr, "", 0)
+
+// AuditEntry records the outcome of a security relevant request.
+type AuditEntry struct {
+	Timestamp   int64  `json:"ts"`
+	RequestID   string `json:"request_id"`
+	Action      string `json:"action"`
+	IP          string `json:"ip"`
+	UserAgent   string `json:"user_agent"`
+	Fingerprint string `json:"fingerprint"`
+	Name        string `json:"name,omitempty"`
+	Outcome     string `json:"outcome"`
+	Error       string `json:"error,omitempty"`
+}
+
+// auditTokenIssue logs an attempt to obtain a token. name is the guest name
+// issued, if any, and errMsg is empty on success.
+func auditTokenIssue(r *http.Request, name, errMsg string) {
+	ip, ua := clientIP(r), r.UserAgent()
+	entry := AuditEntry{
+		Timestamp:   time.Now().Unix(),
+		RequestID:   requestID(r.Context()),
+		Action:      "token_issue",
+		IP:          ip,
+		UserAgent:   ua,
+		Fingerprint: fingerprint(ip, ua),
+		Name:        name,
+		Outcome:     "ok",
+		Error:       errMsg,
+	}
+	if errMsg != "" {
+		entry.Outcome = "error"
+	}
+	b, _ := json.Marshal(entry)
+	auditLog.Println(string(b))
+}
+
+// fingerprint identifies a client by the first 8 bytes of the SHA-256 of its
+// IP address and user agent, so that requests can be correlated without
+// keeping the two together in the clear.
+func fingerprint(ip, userAgent string) string {
+	sum := sha256.Sum256([]byte(ip + userAgent))
+	return hex.EncodeToString(sum[:8])
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokenRequestsAreAudited(t *testing.T) {
+	var buf bytes.Buffer
+	auditLog.SetOutput(&buf)
+	defer auditLog.SetOutput(os.Stderr)
+	tokenThrottle = newIPThrottle(1, time.Minute, 0, 0)
+	defer func() { tokenThrottle = nil }()
+
+	const userAgent = "audit-test/1.0"
+	var issued TokenResponse
+	for _, want := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		r := httptest.NewRequest("POST", "/api/auth/token", nil)
+		r.Header.Set("User-Agent", userAgent)
+		rec := httptest.NewRecorder()
+		handleGetToken(rec, r)
+		if rec.Code != want {
+			t.Fatalf("status = %d, want %d", rec.Code, want)
+		}
+		if want == http.StatusOK {
+			json.NewDecoder(rec.Body).Decode(&issued)
+		}
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d audit entries, want 2", len(lines))
+	}
+	var entry AuditEntry
+	if err := json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+		t.Fatal(err)
+	}
+	// httptest requests come from 192.0.2.1.
+	if entry.Outcome != "ok" || entry.Name != issued.GuestName || entry.Name == "" {
+		t.Errorf("issued entry = %+v, want outcome ok for %q", entry, issued.GuestName)
+	}
+	if want := fingerprint("192.0.2.1", userAgent); entry.IP != "192.0.2.1" || entry.UserAgent != userAgent || entry.Fingerprint != want {
+		t.Errorf("issued entry = %+v, want fingerprint %s of 192.0.2.1 and %q", entry, want, userAgent)
+	}
+
+	entry = AuditEntry{}
+	if err := json.Unmarshal([]byte(lines[1]), &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry.Outcome != "error" || entry.Error != "Too many requests" {
+		t.Errorf("rate limited entry = %+v, want outcome error", entry)
+	}
+}
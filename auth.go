@@ -1,26 +1,61 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
 	"net/http"
 	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/websocket"
 )
 
 // JWT secret key - in production, use environment variable
 var jwtSecret = []byte("your-secret-key-change-in-production")
 
+// Prefix of the first message of a connection opened without a token when
+// -allow-lazy-auth is set. The rest of the message is the JWT.
+const authPrefix = "AUTH:"
+
+const (
+	// Time a lazily authenticated connection has to send its token.
+	lazyAuthTimeout = 5 * time.Second
+
+	// Maximum size of the authentication message.
+	maxAuthMessageSize = 4096
+)
+
+// Lifetime of the tokens issued by the token endpoint.
+const tokenLifetime = 24 * time.Hour
+
+// Name of the cookie holding the raw JWT, set by the token endpoint.
+const sessionCookieName = "chat_session"
+
+// Limits the tokens issued per IP address, if set. Checked by the token
+// endpoint itself rather than through ipThrottle.wrap, so that rejected
+// requests are audited as well.
+var tokenThrottle *ipThrottle
+
+// Revoked token IDs, populated by the logout endpoint.
+var jtiDenyList = newShardedDenyList(denyListShards)
+
 type Claims struct {
 	GuestName string `json:"guest_name"`
+	TenantID  string `json:"tenant_id,omitempty"`
+	Tier      string `json:"tier,omitempty"`
 	jwt.RegisteredClaims
 }
 
 type TokenResponse struct {
 	Token     string `json:"token"`
 	GuestName string `json:"guest_name"`
+	TenantID  string `json:"tenant_id,omitempty"`
+	Tier      string `json:"tier"`
 	ExpiresAt int64  `json:"expires_at"`
 }
 
@@ -28,12 +63,20 @@ type ErrorResponse struct {
 	Error string `json:"error"`
 }
 
-// generateGuestToken creates a JWT token for a guest user
-func generateGuestToken(guestName string) (string, int64, error) {
-	expirationTime := time.Now().Add(24 * time.Hour)
+// generateGuestToken creates a JWT token for a guest user of a tenant
+func generateGuestToken(guestName, tenantID, tier string) (string, int64, error) {
+	jti, err := newTokenID()
+	if err != nil {
+		return "", 0, err
+	}
+
+	expirationTime := time.Now().Add(tokenLifetime)
 	claims := &Claims{
 		GuestName: guestName,
+		TenantID:  tenantID,
+		Tier:      tier,
 		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        jti,
 			ExpiresAt: jwt.NewNumericDate(expirationTime),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
 		},
@@ -48,8 +91,21 @@ func generateGuestToken(guestName string) (string, int64, error) {
 	return tokenString, expirationTime.Unix(), nil
 }
 
+// newTokenID returns a random identifier for the jti claim
+func newTokenID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
 // validateToken validates a JWT token and returns the claims
-func validateToken(tokenString string) (*Claims, error) {
+func validateToken(tokenString string, opts ...ValidateOption) (*Claims, error) {
+	o := validateOptions{validator: claimsValidator}
+	for _, opt := range opts {
+		opt(&o)
+	}
 	claims := &Claims{}
 
 	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
@@ -60,22 +116,75 @@ func validateToken(tokenString string) (*Claims, error) {
 	})
 
 	if err != nil {
-		return nil, err
+		return nil, &AuthError{Code: authInvalidToken, Message: "invalid token", Cause: err}
 	}
 
 	if !token.Valid {
-		return nil, fmt.Errorf("invalid token")
+		return nil, &AuthError{Code: authInvalidToken, Message: "invalid token"}
+	}
+
+	if jtiDenyList.Contains(claims.ID) {
+		return nil, &AuthError{Code: authTokenRevoked, Message: "token has been revoked"}
+	}
+
+	if err := validateClaims(o.validator, claims); err != nil {
+		return nil, err
 	}
 
 	return claims, nil
 }
 
+// validateClaims runs v on claims, turning a rejection into an AuthError.
+func validateClaims(v ClaimsValidator, claims *Claims) error {
+	if err := v.Validate(claims); err != nil {
+		var authErr *AuthError
+		if errors.As(err, &authErr) {
+			return err
+		}
+		return &AuthError{Code: authClaimsRejected, Message: "claims rejected", Cause: err}
+	}
+	return nil
+}
+
 // handleGetToken generates and returns a guest token
 func handleGetToken(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+	// Every attempt is audited, whatever its outcome.
+	fail := func(status int, msg string) {
+		auditTokenIssue(r, "", msg)
 		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusMethodNotAllowed)
-		json.NewEncoder(w).Encode(ErrorResponse{Error: "Method not allowed"})
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: msg})
+	}
+
+	if tokenThrottle != nil {
+		if ok, _ := tokenThrottle.allow(clientIP(r)); !ok {
+			log.Printf("request_id=%s Rate limited address %s", requestID(r.Context()), clientIP(r))
+			fail(http.StatusTooManyRequests, "Too many requests")
+			return
+		}
+	}
+
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		fail(http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	tenantID := r.FormValue("tenant")
+	if !tenantIDPattern.MatchString(tenantID) {
+		fail(http.StatusBadRequest, "Invalid tenant")
+		return
+	}
+	if !canGrantTenant(tenantID, r.FormValue("tenant_grant_secret")) {
+		fail(http.StatusForbidden, "Tenant not allowed")
+		return
+	}
+
+	tier := r.FormValue("tier")
+	if tier == "" {
+		tier = defaultTier
+	}
+	if !canGrantTier(tier, r.FormValue("tier_grant_secret")) {
+		fail(http.StatusForbidden, "Tier not allowed")
 		return
 	}
 
@@ -83,33 +192,108 @@ func handleGetToken(w http.ResponseWriter, r *http.Request) {
 	guestName := fmt.Sprintf("guest-%s", randomHexStrings())
 
 	// Generate JWT token
-	token, expiresAt, err := generateGuestToken(guestName)
+	token, expiresAt, err := generateGuestToken(guestName, tenantID, tier)
 	if err != nil {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to generate token"})
+		fail(http.StatusInternalServerError, "Failed to generate token")
 		return
 	}
+	auditTokenIssue(r, guestName, "")
+
+	// Also hand out the token as a session cookie, which browsers send along
+	// with the WebSocket upgrade request.
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    token,
+		Path:     "/",
+		Expires:  time.Unix(expiresAt, 0),
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+	})
 
 	// Return token response
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(TokenResponse{
 		Token:     token,
 		GuestName: guestName,
+		TenantID:  tenantID,
+		Tier:      tier,
 		ExpiresAt: expiresAt,
 	})
 }
 
+// handleLogout revokes the Bearer token in the Authorization header, or else
+// the one in the session cookie, and disconnects any WebSocket session that
+// was opened with it. The session cookie is cleared either way.
+func handleLogout(tenants *TenantHub, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Method not allowed"})
+		return
+	}
+
+	token, ok := bearerToken(r)
+	if !ok {
+		if cookie, err := r.Cookie(sessionCookieName); err == nil && cookie.Value != "" {
+			token, ok = cookie.Value, true
+		}
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+	})
+
+	if !ok {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Missing token"})
+		return
+	}
+
+	claims, err := validateToken(token)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(errorStatus(err))
+		json.NewEncoder(w).Encode(ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	// Tokens issued before jti was added cannot be revoked individually.
+	// Tokens without exp are not issued here; keep their jti for as long as
+	// an issued token would live.
+	if claims.ID != "" {
+		expiry := time.Now().Add(tokenLifetime)
+		if claims.ExpiresAt != nil {
+			expiry = claims.ExpiresAt.Time
+		}
+		jtiDenyList.Add(claims.ID, expiry)
+		tenants.revoke(claims.TenantID, claims.ID)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// bearerToken returns the token from an "Authorization: Bearer" header
+func bearerToken(r *http.Request) (string, bool) {
+	parts := strings.Split(r.Header.Get("Authorization"), " ")
+	if len(parts) == 2 && parts[0] == "Bearer" {
+		return parts[1], true
+	}
+	return "", false
+}
+
 // extractTokenFromRequest extracts JWT token from request
-// Supports: Authorization header, query parameter, or first message
+// Supports: Authorization header, query parameter, or session cookie
 func extractTokenFromRequest(r *http.Request) (string, error) {
 	// Method 1: Check Authorization header
-	authHeader := r.Header.Get("Authorization")
-	if authHeader != "" {
-		parts := strings.Split(authHeader, " ")
-		if len(parts) == 2 && parts[0] == "Bearer" {
-			return parts[1], nil
-		}
+	if token, ok := bearerToken(r); ok {
+		return token, nil
 	}
 
 	// Method 2: Check query parameter
@@ -118,20 +302,37 @@ func extractTokenFromRequest(r *http.Request) (string, error) {
 		return token, nil
 	}
 
-	return "", fmt.Errorf("no token found in request")
+	// Method 3: Check session cookie
+	if cookie, err := r.Cookie(sessionCookieName); err == nil && cookie.Value != "" {
+		return cookie.Value, nil
+	}
+
+	return "", &AuthError{Code: authMissingToken, Message: "no token found in request"}
 }
 
-// authenticateWebSocket validates the token and returns guest name
-func authenticateWebSocket(r *http.Request) (string, error) {
-	token, err := extractTokenFromRequest(r)
+// authenticateFirstMessage waits for a connection opened without a token to
+// send "AUTH:<jwt>" as its first message and returns the token's claims.
+func authenticateFirstMessage(conn *websocket.Conn) (*Claims, error) {
+	conn.SetReadLimit(maxAuthMessageSize)
+	conn.SetReadDeadline(time.Now().Add(lazyAuthTimeout))
+	_, message, err := conn.ReadMessage()
 	if err != nil {
-		return "", err
+		return nil, &AuthError{Code: authMissingToken, Message: "no authentication message", Cause: err}
 	}
+	token, ok := strings.CutPrefix(string(message), authPrefix)
+	if !ok {
+		return nil, &AuthError{Code: authMissingToken, Message: "first message is not " + authPrefix + "<jwt>"}
+	}
+	conn.SetReadLimit(0)
+	return validateToken(strings.TrimSpace(token))
+}
 
-	claims, err := validateToken(token)
+// authenticateWebSocket validates the token and returns its claims
+func authenticateWebSocket(r *http.Request) (*Claims, error) {
+	token, err := extractTokenFromRequest(r)
 	if err != nil {
-		return "", fmt.Errorf("invalid token: %v", err)
+		return nil, err
 	}
 
-	return claims.GuestName, nil
+	return validateToken(token)
 }
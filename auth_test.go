@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/websocket"
+)
+
+func TestLogoutWithCookieClearsIt(t *testing.T) {
+	tenants := newTenantHub()
+	token := newTestToken(t, "guest-a", "")
+	r := httptest.NewRequest("POST", "/api/auth/logout", nil)
+	r.AddCookie(&http.Cookie{Name: sessionCookieName, Value: token})
+	rec := httptest.NewRecorder()
+	handleLogout(tenants, rec, r)
+
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusNoContent)
+	}
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != sessionCookieName || cookies[0].MaxAge >= 0 {
+		t.Errorf("cookies = %v, want %s cleared", cookies, sessionCookieName)
+	}
+	if _, err := validateToken(token); err == nil {
+		t.Error("token still valid after logout")
+	}
+}
+
+func TestLogoutClosesConnections4004(t *testing.T) {
+	srv, _ := newTestServer(t)
+	token := newTestToken(t, "guest-a", "")
+	conn := dialTest(t, srv, token)
+
+	r, _ := http.NewRequest("POST", srv.URL+"/api/auth/logout", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusNoContent)
+	}
+	if code := readCloseCode(t, conn, time.Second); code != closeTokenRevoked {
+		t.Errorf("close code = %d, want %d", code, closeTokenRevoked)
+	}
+}
+
+func TestLogoutWithoutExpiry(t *testing.T) {
+	jti, err := newTokenID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims := &Claims{GuestName: "guest-a", RegisteredClaims: jwt.RegisteredClaims{ID: jti}}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(jwtSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("POST", "/api/auth/logout", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	handleLogout(newTenantHub(), rec, r)
+
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusNoContent)
+	}
+	if !jtiDenyList.Contains(jti) {
+		t.Error("jti not denied")
+	}
+}
+
+func TestLazyAuth(t *testing.T) {
+	*allowLazyAuth = true
+	defer func() { *allowLazyAuth = false }()
+	srv, _ := newTestServer(t)
+
+	conn := dialTest(t, srv, "")
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(authPrefix+newTestToken(t, "guest-a", ""))); err != nil {
+		t.Fatal(err)
+	}
+	if got := readText(t, conn); got != "IDENTITY:guest-a" {
+		t.Errorf("reply to AUTH = %q, want IDENTITY:guest-a", got)
+	}
+	peer := dialTest(t, srv, newTestToken(t, "guest-b", ""))
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if got := readText(t, peer); got != "guest-a: hello" {
+		t.Errorf("peer got %q, want guest-a: hello", got)
+	}
+
+	for _, first := range []string{"hello", authPrefix + "not-a-jwt"} {
+		conn := dialTest(t, srv, "")
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(first)); err != nil {
+			t.Fatal(err)
+		}
+		if code := readCloseCode(t, conn, time.Second); code != closeAuthFailed {
+			t.Errorf("first message %q: close code = %d, want %d", first, code, closeAuthFailed)
+		}
+	}
+}
+
+func TestLazyAuthTimeout(t *testing.T) {
+	*allowLazyAuth = true
+	defer func() { *allowLazyAuth = false }()
+	srv, _ := newTestServer(t)
+
+	conn := dialTest(t, srv, "")
+	start := time.Now()
+	if code := readCloseCode(t, conn, lazyAuthTimeout+2*time.Second); code != closeAuthFailed {
+		t.Errorf("close code = %d, want %d", code, closeAuthFailed)
+	}
+	if elapsed := time.Since(start); elapsed < lazyAuthTimeout-100*time.Millisecond {
+		t.Errorf("closed after %v, want %v", elapsed, lazyAuthTimeout)
+	}
+}
+
+func TestExtractTokenPrefersHeader(t *testing.T) {
+	r := httptest.NewRequest("GET", "/ws?token=query", nil)
+	r.Header.Set("Authorization", "Bearer header")
+	r.AddCookie(&http.Cookie{Name: sessionCookieName, Value: "cookie"})
+	if got, _ := extractTokenFromRequest(r); got != "header" {
+		t.Errorf("with header, query and cookie got %q, want header", got)
+	}
+
+	r = httptest.NewRequest("GET", "/ws?token=query", nil)
+	r.AddCookie(&http.Cookie{Name: sessionCookieName, Value: "cookie"})
+	if got, _ := extractTokenFromRequest(r); got != "query" {
+		t.Errorf("with query and cookie got %q, want query", got)
+	}
+
+	r = httptest.NewRequest("GET", "/ws", nil)
+	r.AddCookie(&http.Cookie{Name: sessionCookieName, Value: "cookie"})
+	if got, _ := extractTokenFromRequest(r); got != "cookie" {
+		t.Errorf("with cookie only got %q, want cookie", got)
+	}
+}
+
+func TestTokenEndpointSetsSessionCookie(t *testing.T) {
+	rec := httptest.NewRecorder()
+	handleGetToken(rec, httptest.NewRequest("POST", "/api/auth/token", nil))
+	var resp TokenResponse
+	json.NewDecoder(rec.Body).Decode(&resp)
+
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("cookies = %v, want one", cookies)
+	}
+	c := cookies[0]
+	if c.Name != sessionCookieName || c.Value != resp.Token {
+		t.Errorf("cookie %s=%q, want %s holding the token", c.Name, c.Value, sessionCookieName)
+	}
+	if !c.HttpOnly || !c.Secure || c.SameSite != http.SameSiteStrictMode || c.Path != "/" {
+		t.Errorf("cookie = %+v, want HttpOnly, Secure, SameSite=Strict and Path=/", c)
+	}
+	if !c.Expires.Equal(time.Unix(resp.ExpiresAt, 0)) {
+		t.Errorf("cookie expires %v, want %v", c.Expires, time.Unix(resp.ExpiresAt, 0))
+	}
+}
+
+func TestTamperedCookieRejected(t *testing.T) {
+	token := newTestToken(t, "guest-a", "")
+	r := httptest.NewRequest("GET", "/ws", nil)
+	r.AddCookie(&http.Cookie{Name: sessionCookieName, Value: token[:len(token)-2] + "xx"})
+	_, err := authenticateWebSocket(r)
+	var authErr *AuthError
+	if !errors.As(err, &authErr) || authErr.Code != authInvalidToken {
+		t.Errorf("error = %v, want %s", err, authInvalidToken)
+	}
+}
@@ -6,12 +6,19 @@ package main
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"math"
 	"net/http"
+	"strconv"
+	"sync/atomic"
 	"time"
 
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/gorilla/websocket"
+	"golang.org/x/time/rate"
 )
 
 const (
@@ -24,15 +31,76 @@ const (
 	// Send pings to peer with this period. Must be less than pongWait.
 	pingPeriod = (pongWait * 9) / 10
 
+	// Shortest period pings are sent with on slow connections.
+	minPingPeriod = 5 * time.Second
+
+	// A pong slower than highRTT halves the client's ping period, so a
+	// dropped connection is noticed sooner. The default period is restored
+	// after restorePongs consecutive pongs faster than lowRTT.
+	highRTT      = 200 * time.Millisecond
+	lowRTT       = 100 * time.Millisecond
+	restorePongs = 3
+
 	// Maximum message size allowed from peer.
 	maxMessageSize = 512
 )
 
+// Application close codes sent to the peer.
+const (
+	// The token used to open the connection was revoked.
+	closeTokenRevoked = 4004
+
+	// Too many anonymous clients are connected.
+	closeAnonymousLimit = 4005
+
+	// The client stopped sending heartbeats.
+	closeHeartbeatTimeout = 4006
+
+	// The client did not authenticate with its first message.
+	closeAuthFailed = 4007
+)
+
+// Smoothing factor of the message rate average kept for each client. Each
+// new sample is the inverse of the time since the previous message.
+const emaAlpha = 0.1
+
+// Maximum number of anonymous clients connected at the same time.
+const maxAnonymousClients = 10
+
 var (
 	newline = []byte{'\n'}
 	space   = []byte{' '}
 )
 
+// Prefix of messages reflected back to their sender in echo mode.
+const echoPrefix = "ECHO:"
+
+// Application-level heartbeat sent by clients, independent of the protocol
+// ping/pong. The server answers with heartbeatAckPrefix followed by its
+// current Unix time.
+const (
+	heartbeatMessage   = "HEARTBEAT"
+	heartbeatAckPrefix = "HEARTBEAT_ACK:"
+)
+
+// Heartbeats arriving less than this long after the last one passed to the
+// hub are dropped without an answer. They are not rate limited like chat
+// messages, so this keeps a client from flooding the hub with them.
+const minHeartbeatInterval = time.Second
+
+// Prefix of error notifications sent to a single client. The rest of the
+// message is an error code, followed for muted by a colon and the Unix time
+// the mute ends.
+const errorPrefix = "ERROR:"
+
+// Prefix of notifications that an admin muted the client. The rest of the
+// message is the Unix time the mute ends, or 0 when the client is unmuted.
+const mutedPrefix = "MUTED:"
+
+// ErrMessageTooLarge is returned by readMessage when a message, after
+// reassembling its frames, exceeds the size limit.
+var ErrMessageTooLarge = errors.New("message too large")
+
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
@@ -42,6 +110,10 @@ var upgrader = websocket.Upgrader{
 type Client struct {
 	hub *Hub
 
+	// The tenants the hub belongs to, which stop the hub once its last
+	// client has left.
+	tenants *TenantHub
+
 	// The websocket connection.
 	conn *websocket.Conn
 
@@ -50,6 +122,54 @@ type Client struct {
 
 	// Guest name for this client.
 	name string
+
+	// ID of the token the connection was authenticated with.
+	jti string
+
+	// ID of the HTTP upgrade request, for correlating log entries.
+	requestID string
+
+	// Maximum number of messages written to the peer per second. Zero
+	// disables the limit.
+	writeRate int
+
+	// Time the last heartbeat was received. Owned by the hub goroutine.
+	lastHeartbeat time.Time
+
+	// Messages sent before this time are rejected. Owned by the hub
+	// goroutine.
+	mutedUntil time.Time
+
+	// Time the connection was established.
+	connectedAt time.Time
+
+	// Tier of the client's token, and its limits.
+	tier   string
+	limits RateLimitConfig
+
+	// Time the last message was read, and the last heartbeat passed to
+	// the hub. Owned by readPump.
+	lastMessage          time.Time
+	lastHeartbeatForward time.Time
+
+	// Period writePump sends pings with, as a time.Duration. Set by readPump
+	// as pongs come in; zero means pingPeriod.
+	pingPeriod atomic.Int64
+
+	// Number of consecutive fast pongs. Owned by readPump.
+	fastPongs int
+
+	// Exponential moving average of the client's message rate per second,
+	// as the bits of a float64. Written by readPump, readable from any
+	// goroutine through emaRate.
+	emaRateBits atomic.Uint64
+
+	// Anonymous clients may only listen; anything they send is rejected.
+	anonymous bool
+
+	// Close frame to send when the hub closes send. Set by the hub before
+	// closing the channel; nil means a close frame without a status.
+	closeMsg []byte
 }
 
 // readPump pumps messages from the websocket connection to the hub.
@@ -59,27 +179,151 @@ type Client struct {
 // reads from this goroutine.
 func (c *Client) readPump() {
 	defer func() {
-		c.hub.unregister <- c
+		c.tenants.unregister(c)
 		c.conn.Close()
 	}()
-	c.conn.SetReadLimit(maxMessageSize)
 	c.conn.SetReadDeadline(time.Now().Add(pongWait))
-	c.conn.SetPongHandler(func(string) error { c.conn.SetReadDeadline(time.Now().Add(pongWait)); return nil })
+	c.conn.SetPongHandler(c.handlePong)
+	limiter := rate.NewLimiter(rate.Limit(c.limits.MessagesPerSec), c.limits.Burst)
+	sanitize := sanitizers[*sanitizeMode]
+	readLimit := maxMessageSize
+	if c.limits.SplitLongMessages {
+		readLimit = maxSplitParts * c.limits.MaxMessageLength
+	}
 	for {
-		_, message, err := c.conn.ReadMessage()
+		message, err := c.readMessage(readLimit)
+		if errors.Is(err, ErrMessageTooLarge) {
+			c.hub.notify <- &Message{sender: c, data: []byte(errorPrefix + "message_too_large")}
+			continue
+		}
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				log.Printf("error: %v", err)
+				log.Printf("request_id=%s error: %v", c.requestID, err)
 			}
 			break
 		}
+		now := time.Now()
+		c.recordMessage(now)
+		if string(bytes.TrimSpace(message)) == heartbeatMessage {
+			if now.Sub(c.lastHeartbeatForward) >= minHeartbeatInterval {
+				c.lastHeartbeatForward = now
+				c.hub.heartbeat <- c
+			}
+			continue
+		}
+		if c.anonymous {
+			c.hub.notify <- &Message{sender: c, data: []byte(errorPrefix + "authentication_required")}
+			continue
+		}
+		if !limiter.Allow() {
+			c.hub.notify <- &Message{sender: c, data: []byte(errorPrefix + "rate_limited")}
+			continue
+		}
 		message = bytes.TrimSpace(bytes.Replace(message, newline, space, -1))
+		if len(message) > c.limits.MaxMessageLength {
+			if !c.limits.SplitLongMessages {
+				c.hub.notify <- &Message{sender: c, data: []byte(errorPrefix + "message_too_long")}
+				continue
+			}
+			// Send the parts as separate messages, tagged with their
+			// position and a thread ID shared by all of them. Long words
+			// can make more parts than the read limit suggests.
+			parts := splitMessage(string(message), c.limits.MaxMessageLength)
+			if len(parts) > maxSplitParts {
+				c.hub.notify <- &Message{sender: c, data: []byte(errorPrefix + "message_too_long")}
+				continue
+			}
+			threadID := newUUID()
+			for i, part := range parts {
+				messageWithName := []byte(fmt.Sprintf("%s: [%d/%d %s] %s", c.name, i+1, len(parts), threadID, sanitize(part)))
+				c.hub.broadcast <- &Message{sender: c, data: messageWithName}
+			}
+			continue
+		}
 		// Prepend the sender's name to the message
-		messageWithName := []byte(fmt.Sprintf("%s: %s", c.name, message))
+		messageWithName := []byte(fmt.Sprintf("%s: %s", c.name, sanitize(string(message))))
 		c.hub.broadcast <- &Message{sender: c, data: messageWithName}
 	}
 }
 
+// readMessage reads the next message from the connection. The size limit
+// applies to the whole message rather than to each frame; an oversized
+// message is discarded and ErrMessageTooLarge returned, leaving the
+// connection usable.
+func (c *Client) readMessage(limit int) ([]byte, error) {
+	_, r, err := c.conn.NextReader()
+	if err != nil {
+		return nil, err
+	}
+	message, err := io.ReadAll(io.LimitReader(r, int64(limit)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(message) > limit {
+		if _, err := io.Copy(io.Discard, r); err != nil {
+			return nil, err
+		}
+		return nil, ErrMessageTooLarge
+	}
+	return message, nil
+}
+
+// handlePong extends the read deadline and adapts the ping period to the
+// round trip time measured by the pong, whose payload is the send time of
+// the ping it answers.
+func (c *Client) handlePong(appData string) error {
+	c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	sent, err := strconv.ParseInt(appData, 10, 64)
+	if err != nil {
+		return nil
+	}
+	rtt := time.Since(time.Unix(0, sent))
+	period := c.currentPingPeriod()
+	switch {
+	case rtt > highRTT:
+		c.fastPongs = 0
+		period = max(period/2, minPingPeriod)
+	case rtt < lowRTT:
+		c.fastPongs++
+		if c.fastPongs >= restorePongs {
+			period = pingPeriod
+		}
+	default:
+		c.fastPongs = 0
+	}
+	c.pingPeriod.Store(int64(period))
+	return nil
+}
+
+// currentPingPeriod returns the period writePump sends pings with.
+func (c *Client) currentPingPeriod() time.Duration {
+	if d := time.Duration(c.pingPeriod.Load()); d > 0 {
+		return d
+	}
+	return pingPeriod
+}
+
+// recordMessage updates the client's message rate average with a message
+// read at now. The first message only starts the clock.
+func (c *Client) recordMessage(now time.Time) {
+	last := c.lastMessage
+	c.lastMessage = now
+	if last.IsZero() {
+		return
+	}
+	elapsed := now.Sub(last).Seconds()
+	if elapsed <= 0 {
+		return
+	}
+	ema := emaAlpha/elapsed + (1-emaAlpha)*c.emaRate()
+	c.emaRateBits.Store(math.Float64bits(ema))
+}
+
+// emaRate returns the average message rate of the client per second.
+func (c *Client) emaRate() float64 {
+	return math.Float64frombits(c.emaRateBits.Load())
+}
+
 // writePump pumps messages from the hub to the websocket connection.
 //
 // A goroutine running writePump is started for each connection. The
@@ -90,14 +334,29 @@ func (c *Client) writePump() {
 	defer func() {
 		ticker.Stop()
 		c.conn.Close()
+		writePumps.Done()
 	}()
+
+	// Leaky bucket spreading bursts out to at most writeRate messages per
+	// second, so a client catching up on a backlog is not overwhelmed.
+	var leak <-chan time.Time
+	coalesceAfter := cap(c.send) * 3 / 4
+	if c.writeRate > 0 {
+		bucket := time.NewTicker(time.Second / time.Duration(c.writeRate))
+		defer bucket.Stop()
+		leak = bucket.C
+	}
 	for {
 		select {
 		case message, ok := <-c.send:
 			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
 			if !ok {
 				// The hub closed the channel.
-				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				closeMsg := c.closeMsg
+				if closeMsg == nil {
+					closeMsg = []byte{}
+				}
+				c.conn.WriteMessage(websocket.CloseMessage, closeMsg)
 				return
 			}
 
@@ -107,50 +366,101 @@ func (c *Client) writePump() {
 			}
 			w.Write(message)
 
-			// Add queued chat messages to the current websocket message.
-			n := len(c.send)
-			for i := 0; i < n; i++ {
-				w.Write(newline)
-				w.Write(<-c.send)
+			// Add queued chat messages to the current websocket message
+			// when there is no rate limit, or when the backlog nears the
+			// size of the send buffer. Pacing must never let the buffer
+			// fill, or the hub drops the client.
+			if n := len(c.send); leak == nil || n > coalesceAfter {
+				for i := 0; i < n; i++ {
+					w.Write(newline)
+					w.Write(<-c.send)
+				}
 			}
 
 			if err := w.Close(); err != nil {
 				return
 			}
+
+			if leak != nil {
+				<-leak
+			}
 		case <-ticker.C:
-			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
-			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+			// The peer echoes the send time back in its pong, so
+			// handlePong can measure the round trip.
+			now := time.Now()
+			c.conn.SetWriteDeadline(now.Add(writeWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, []byte(strconv.FormatInt(now.UnixNano(), 10))); err != nil {
 				return
 			}
+			ticker.Reset(c.currentPingPeriod())
 		}
 	}
 }
 
-// serveWs handles websocket requests from the peer.
-func serveWs(hub *Hub, w http.ResponseWriter, r *http.Request) {
+// serveWs handles websocket requests from the peer, connecting it to the hub
+// of the tenant named in its token.
+func serveWs(tenants *TenantHub, w http.ResponseWriter, r *http.Request) {
 	// Authenticate the request
-	guestName, err := authenticateWebSocket(r)
+	reqID := requestID(r.Context())
+	if draining.Load() {
+		http.Error(w, "Server shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	claims, err := authenticateWebSocket(r)
+	anonymous, lazy := false, false
+	var authErr *AuthError
+	if errors.As(err, &authErr) && authErr.Code == authMissingToken {
+		switch {
+		case *allowLazyAuth:
+			err, lazy = nil, true
+		case *allowAnonymous:
+			// Anonymous clients join the default tenant, so they are
+			// subject to the same claims validation as tokens, e.g. to
+			// -allowed-tenants. The claims last as long as a token would.
+			now := time.Now()
+			claims = &Claims{
+				GuestName: fmt.Sprintf("anon-%s", randomHexStrings()),
+				RegisteredClaims: jwt.RegisteredClaims{
+					IssuedAt:  jwt.NewNumericDate(now),
+					ExpiresAt: jwt.NewNumericDate(now.Add(tokenLifetime)),
+				},
+			}
+			err, anonymous = validateClaims(claimsValidator, claims), true
+		}
+	}
 	if err != nil {
-		log.Printf("Authentication failed: %v", err)
-		http.Error(w, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
+		log.Printf("request_id=%s Authentication failed: %v", reqID, err)
+		http.Error(w, "Unauthorized: "+err.Error(), errorStatus(err))
 		return
 	}
 
-	conn, err := upgrader.Upgrade(w, r, nil)
+	// The upgrader writes its own response, so pass the request ID along.
+	conn, err := upgrader.Upgrade(w, r, http.Header{requestIDHeader: {reqID}, protocolVersionHeader: {ProtocolVersion}})
 	if err != nil {
-		log.Println(err)
+		log.Printf("request_id=%s %v", reqID, err)
 		return
 	}
+	if lazy {
+		if claims, err = authenticateFirstMessage(conn); err != nil {
+			log.Printf("request_id=%s Authentication failed: %v", reqID, err)
+			rejectConn(conn, closeAuthFailed, err)
+			return
+		}
+	}
+	log.Printf("request_id=%s WebSocket connected: %s", reqID, claims.GuestName)
 
-	client := &Client{hub: hub, conn: conn, send: make(chan []byte, 256), name: guestName}
-	client.hub.register <- client
+	client := &Client{conn: conn, send: make(chan []byte, 256), name: claims.GuestName, jti: claims.ID, requestID: reqID, writeRate: *writeRateLimit, tier: effectiveTier(claims.Tier), connectedAt: time.Now(), limits: limitsFor(claims.Tier), anonymous: anonymous}
 
-	// Send the guest name to the client
-	welcomeMsg := []byte(fmt.Sprintf("IDENTITY:%s", guestName))
+	// Send the guest name to the client. This is queued before registering
+	// because the hub may reject the client and close send straight away.
+	welcomeMsg := []byte(fmt.Sprintf("IDENTITY:%s", claims.GuestName))
 	client.send <- welcomeMsg
 
+	tenants.register(claims.TenantID, client)
+
 	// Allow collection of memory referenced by the caller by doing all work in
 	// new goroutines.
+	writePumps.Add(1)
 	go client.writePump()
 	go client.readPump()
 }
@@ -164,3 +474,18 @@ func randomHexStrings() string {
 	}
 	return string(b)
 }
+
+// rejectConn sends the code of err as an error message and closes conn with
+// closeCode. It is used before the pumps are started, while the caller is the
+// only writer.
+func rejectConn(conn *websocket.Conn, closeCode int, err error) {
+	code := "internal_error"
+	var authErr *AuthError
+	if errors.As(err, &authErr) {
+		code = authErr.Code
+	}
+	conn.SetWriteDeadline(time.Now().Add(writeWait))
+	conn.WriteMessage(websocket.TextMessage, []byte(errorPrefix+code))
+	conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(closeCode, code), time.Now().Add(writeWait))
+	conn.Close()
+}
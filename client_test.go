@@ -0,0 +1,182 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestWriteRatePacesMessages(t *testing.T) {
+	srv, tenants := newTestServer(t)
+	conn := dialTest(t, srv, newTestToken(t, "guest-a", ""))
+
+	// A burst of 100 at the default rate of 50 per second takes at least
+	// 100/50 - 1 seconds, one message per frame.
+	start := time.Now()
+	for i := range 100 {
+		tenants.announce("", []byte("m"+strconv.Itoa(i)))
+	}
+	for i := range 100 {
+		if got, want := readText(t, conn), "m"+strconv.Itoa(i); got != want {
+			t.Fatalf("frame %d = %q, want %q alone", i, got, want)
+		}
+	}
+	if elapsed, want := time.Since(start), time.Duration(100 / *writeRateLimit - 1)*time.Second; elapsed < want {
+		t.Errorf("100 messages at %d/s took %v, want at least %v", *writeRateLimit, elapsed, want)
+	}
+}
+
+func TestWriteRateCoalescesBacklog(t *testing.T) {
+	*writeRateLimit = 5
+	defer func() { *writeRateLimit = 50 }()
+	srv, tenants := newTestServer(t)
+	conn := dialTest(t, srv, newTestToken(t, "guest-a", ""))
+
+	// More than three quarters of the 256 message send buffer.
+	const backlog = 250
+	for i := range backlog {
+		tenants.announce("", []byte("m"+strconv.Itoa(i)))
+	}
+	var lines []string
+	frames := 0
+	for len(lines) < backlog {
+		lines = append(lines, strings.Split(readText(t, conn), "\n")...)
+		frames++
+	}
+	if frames > 3 {
+		t.Errorf("backlog of %d at 5/s took %d frames, want it coalesced", backlog, frames)
+	}
+	for i, line := range lines {
+		if want := "m" + strconv.Itoa(i); line != want {
+			t.Fatalf("line %d = %q, want %q", i, line, want)
+		}
+	}
+}
+
+func TestEMARateConverges(t *testing.T) {
+	c := &Client{}
+	now := time.Now()
+	for range 100 {
+		now = now.Add(200 * time.Millisecond)
+		c.recordMessage(now)
+	}
+	if got := c.emaRate(); math.Abs(got-5) > 0.01 {
+		t.Errorf("rate after 100 messages at 5/s = %v, want 5", got)
+	}
+
+	// A sudden burst pulls the average up by alpha of the new rate each
+	// message.
+	before := c.emaRate()
+	now = now.Add(10 * time.Millisecond)
+	c.recordMessage(now)
+	if got, want := c.emaRate(), emaAlpha*100+(1-emaAlpha)*before; math.Abs(got-want) > 1e-9 {
+		t.Errorf("rate after a message 10ms later = %v, want %v", got, want)
+	}
+}
+
+// serverConn returns the server side of a fresh websocket connection.
+func serverConn(t *testing.T) *websocket.Conn {
+	t.Helper()
+	conns := make(chan *websocket.Conn, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		conns <- conn
+	}))
+	t.Cleanup(srv.Close)
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	conn := <-conns
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestHandlePongAdaptsPingPeriod(t *testing.T) {
+	const (
+		slow   = time.Second
+		medium = 150 * time.Millisecond
+		fast   = 10 * time.Millisecond
+	)
+	tests := []struct {
+		name  string
+		pongs []time.Duration
+		want  []time.Duration
+	}{
+		{
+			name:  "halves to the floor",
+			pongs: []time.Duration{slow, slow, slow, slow, slow},
+			want:  []time.Duration{27 * time.Second, 13500 * time.Millisecond, 6750 * time.Millisecond, minPingPeriod, minPingPeriod},
+		},
+		{
+			name:  "restored after three fast pongs",
+			pongs: []time.Duration{slow, fast, fast, fast},
+			want:  []time.Duration{27 * time.Second, 27 * time.Second, 27 * time.Second, pingPeriod},
+		},
+		{
+			name:  "a medium pong restarts the count",
+			pongs: []time.Duration{slow, fast, fast, medium, fast, fast, fast},
+			want:  []time.Duration{27 * time.Second, 27 * time.Second, 27 * time.Second, 27 * time.Second, 27 * time.Second, 27 * time.Second, pingPeriod},
+		},
+		{
+			name:  "ignores pongs without a send time",
+			pongs: []time.Duration{-1},
+			want:  []time.Duration{pingPeriod},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Client{conn: serverConn(t)}
+			for i, rtt := range tt.pongs {
+				payload := "not a time"
+				if rtt >= 0 {
+					payload = strconv.FormatInt(time.Now().Add(-rtt).UnixNano(), 10)
+				}
+				c.handlePong(payload)
+				if got := c.currentPingPeriod(); got != tt.want[i] {
+					t.Errorf("period after pong %d = %v, want %v", i, got, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestOversizedFragmentedMessage(t *testing.T) {
+	srv, _ := newTestServer(t)
+	// A small write buffer makes the client send frames of under 100
+	// bytes, each within the read limit on its own.
+	dialer := websocket.Dialer{WriteBufferSize: 100}
+	conn, _, err := dialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws?token="+newTestToken(t, "guest-a", ""), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	readText(t, conn)
+
+	w, err := conn.NextWriter(websocket.TextMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 10 {
+		w.Write([]byte(strings.Repeat("x", maxMessageSize/8)))
+	}
+	w.Close()
+	if got := readText(t, conn); got != errorPrefix+"message_too_large" {
+		t.Fatalf("reply = %q, want %smessage_too_large", got, errorPrefix)
+	}
+
+	if reply := chatReply(t, conn, heartbeatMessage); !strings.HasPrefix(reply, heartbeatAckPrefix) {
+		t.Errorf("reply after the oversized message = %q, want %s", reply, heartbeatAckPrefix)
+	}
+}
@@ -0,0 +1,324 @@
+// Command loadtest connects a number of virtual clients to a chat server,
+// has each of them send messages at a fixed rate, and reports connection and
+// message latencies as JSON.
+//
+// Round-trip latency is measured from the time a message is sent until it is
+// read back: by the sender itself when the server runs with -echo-mode, or by
+// any other client when messages are broadcast.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var (
+	target   = flag.String("target", "ws://localhost:8025/ws", "websocket endpoint of the chat server")
+	tokenURL = flag.String("token-url", "", "token endpoint (default derived from -target)")
+	clients  = flag.Int("clients", 100, "number of virtual clients")
+	duration = flag.Duration("duration", 30*time.Second, "how long each client sends messages")
+	rate     = flag.Int("rate", 10, "messages per second sent by each client")
+	promFile = flag.String("prom-file", "", "also write results in Prometheus text format to this file")
+)
+
+// Prefix of the messages sent by virtual clients. The rest of the message is
+// the send time in nanoseconds since the Unix epoch.
+const probePrefix = "loadtest "
+
+// Time allowed for in-flight messages to arrive after the last send.
+const drainWait = 2 * time.Second
+
+// How often virtual clients send a heartbeat so the server keeps them
+// connected during long runs.
+const heartbeatPeriod = 30 * time.Second
+
+// Latencies summarizes a latency distribution in milliseconds.
+type Latencies struct {
+	Count int     `json:"count"`
+	P50   float64 `json:"p50_ms"`
+	P99   float64 `json:"p99_ms"`
+	P999  float64 `json:"p999_ms"`
+}
+
+// Result is the report written to stdout.
+type Result struct {
+	Clients          int       `json:"clients"`
+	Duration         string    `json:"duration"`
+	Rate             int       `json:"rate"`
+	Connect          Latencies `json:"connect"`
+	RoundTrip        Latencies `json:"round_trip"`
+	ConnectionErrors int       `json:"connection_errors"`
+	MessagesSent     int       `json:"messages_sent"`
+	MessagesReceived int       `json:"messages_received"`
+	Throughput       float64   `json:"throughput_msgs_per_sec"`
+}
+
+// stats collects measurements from all virtual clients.
+type stats struct {
+	mu         sync.Mutex
+	connect    []time.Duration
+	roundTrip  []time.Duration
+	connErrors int
+	sent       int
+}
+
+func (s *stats) addConnect(d time.Duration) {
+	s.mu.Lock()
+	s.connect = append(s.connect, d)
+	s.mu.Unlock()
+}
+
+func (s *stats) addRoundTrip(d time.Duration) {
+	s.mu.Lock()
+	s.roundTrip = append(s.roundTrip, d)
+	s.mu.Unlock()
+}
+
+func (s *stats) addConnError() {
+	s.mu.Lock()
+	s.connErrors++
+	s.mu.Unlock()
+}
+
+func (s *stats) addSent() {
+	s.mu.Lock()
+	s.sent++
+	s.mu.Unlock()
+}
+
+func main() {
+	flag.Parse()
+	if *clients <= 0 || *rate <= 0 {
+		log.Fatal("-clients and -rate must be positive")
+	}
+	if *tokenURL == "" {
+		u, err := defaultTokenURL(*target)
+		if err != nil {
+			log.Fatal(err)
+		}
+		*tokenURL = u
+	}
+
+	res := runLoad(*target, *tokenURL)
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(res); err != nil {
+		log.Fatal(err)
+	}
+	if *promFile != "" {
+		if err := os.WriteFile(*promFile, promText(res), 0o644); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// runLoad runs the configured number of virtual clients against the
+// websocket endpoint target, with tokens from tokenURL, and reports on them.
+func runLoad(target, tokenURL string) Result {
+	s := &stats{}
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < *clients; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runClient(s, target, tokenURL)
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	return Result{
+		Clients:          *clients,
+		Duration:         duration.String(),
+		Rate:             *rate,
+		Connect:          summarize(s.connect),
+		RoundTrip:        summarize(s.roundTrip),
+		ConnectionErrors: s.connErrors,
+		MessagesSent:     s.sent,
+		MessagesReceived: len(s.roundTrip),
+		Throughput:       float64(len(s.roundTrip)) / elapsed.Seconds(),
+	}
+}
+
+// defaultTokenURL maps ws://host/ws to http://host/api/auth/token.
+func defaultTokenURL(wsURL string) (string, error) {
+	u, err := url.Parse(wsURL)
+	if err != nil {
+		return "", err
+	}
+	switch u.Scheme {
+	case "ws":
+		u.Scheme = "http"
+	case "wss":
+		u.Scheme = "https"
+	default:
+		return "", fmt.Errorf("unsupported target scheme %q", u.Scheme)
+	}
+	u.Path = "/api/auth/token"
+	u.RawQuery = ""
+	return u.String(), nil
+}
+
+// fetchToken requests a guest token from the token endpoint at tokenURL.
+func fetchToken(tokenURL string) (string, error) {
+	resp, err := http.Get(tokenURL)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token request failed: %s", resp.Status)
+	}
+	var body struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", err
+	}
+	return body.Token, nil
+}
+
+// runClient connects one virtual client to target, sends messages for the
+// configured duration and records the latency of every probe message it
+// reads back.
+func runClient(s *stats, target, tokenURL string) {
+	token, err := fetchToken(tokenURL)
+	if err != nil {
+		log.Printf("token: %v", err)
+		s.addConnError()
+		return
+	}
+
+	u, _ := url.Parse(target)
+	q := u.Query()
+	q.Set("token", token)
+	u.RawQuery = q.Encode()
+
+	dialStart := time.Now()
+	conn, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	if err != nil {
+		log.Printf("dial: %v", err)
+		s.addConnError()
+		return
+	}
+	s.addConnect(time.Since(dialStart))
+	defer conn.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			_, message, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			now := time.Now()
+			for _, line := range bytes.Split(message, []byte{'\n'}) {
+				if sent, ok := probeTime(line); ok {
+					s.addRoundTrip(now.Sub(sent))
+				}
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(time.Second / time.Duration(*rate))
+	defer ticker.Stop()
+	heartbeat := time.NewTicker(heartbeatPeriod)
+	defer heartbeat.Stop()
+	stop := time.After(*duration)
+loop:
+	for {
+		select {
+		case <-heartbeat.C:
+			if err := conn.WriteMessage(websocket.TextMessage, []byte("HEARTBEAT")); err != nil {
+				log.Printf("write: %v", err)
+				break loop
+			}
+		case <-ticker.C:
+			msg := probePrefix + strconv.FormatInt(time.Now().UnixNano(), 10)
+			if err := conn.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+				log.Printf("write: %v", err)
+				break loop
+			}
+			s.addSent()
+		case <-done:
+			break loop
+		case <-stop:
+			break loop
+		}
+	}
+
+	// Give in-flight messages a chance to arrive before hanging up.
+	select {
+	case <-done:
+	case <-time.After(drainWait):
+	}
+	conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+}
+
+// probeTime extracts the send time from a relayed probe message of the form
+// "[ECHO:]<name>: loadtest <nanos>".
+func probeTime(line []byte) (time.Time, bool) {
+	i := bytes.Index(line, []byte(probePrefix))
+	if i < 0 {
+		return time.Time{}, false
+	}
+	nanos, err := strconv.ParseInt(string(line[i+len(probePrefix):]), 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(0, nanos), true
+}
+
+// summarize computes percentiles of ds.
+func summarize(ds []time.Duration) Latencies {
+	l := Latencies{Count: len(ds)}
+	if len(ds) == 0 {
+		return l
+	}
+	sort.Slice(ds, func(i, j int) bool { return ds[i] < ds[j] })
+	pct := func(p float64) float64 {
+		i := int(math.Ceil(p*float64(len(ds)))) - 1
+		if i < 0 {
+			i = 0
+		}
+		return float64(ds[i]) / float64(time.Millisecond)
+	}
+	l.P50 = pct(0.50)
+	l.P99 = pct(0.99)
+	l.P999 = pct(0.999)
+	return l
+}
+
+// promText renders res in the Prometheus text exposition format.
+func promText(res Result) []byte {
+	var b bytes.Buffer
+	writeLatencies := func(name string, l Latencies) {
+		fmt.Fprintf(&b, "# TYPE %s summary\n", name)
+		fmt.Fprintf(&b, "%s{quantile=\"0.5\"} %g\n", name, l.P50/1000)
+		fmt.Fprintf(&b, "%s{quantile=\"0.99\"} %g\n", name, l.P99/1000)
+		fmt.Fprintf(&b, "%s{quantile=\"0.999\"} %g\n", name, l.P999/1000)
+		fmt.Fprintf(&b, "%s_count %d\n", name, l.Count)
+	}
+	writeLatencies("loadtest_connect_seconds", res.Connect)
+	writeLatencies("loadtest_round_trip_seconds", res.RoundTrip)
+	fmt.Fprintf(&b, "# TYPE loadtest_connection_errors_total counter\nloadtest_connection_errors_total %d\n", res.ConnectionErrors)
+	fmt.Fprintf(&b, "# TYPE loadtest_messages_sent_total counter\nloadtest_messages_sent_total %d\n", res.MessagesSent)
+	fmt.Fprintf(&b, "# TYPE loadtest_messages_received_total counter\nloadtest_messages_received_total %d\n", res.MessagesReceived)
+	fmt.Fprintf(&b, "# TYPE loadtest_throughput_messages_per_second gauge\nloadtest_throughput_messages_per_second %g\n", res.Throughput)
+	return b.Bytes()
+}
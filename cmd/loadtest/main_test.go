@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// newEchoServer stands in for a chat server running with -echo-mode.
+func newEchoServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	upgrader := websocket.Upgrader{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/auth/token", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{"token": "test"})
+	})
+	mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			_, message, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			conn.WriteMessage(websocket.TextMessage, append([]byte("ECHO:guest-a: "), message...))
+		}
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestRunLoad(t *testing.T) {
+	*clients, *duration, *rate = 3, 500*time.Millisecond, 20
+	srv := newEchoServer(t)
+	target := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws"
+	tokenURL, err := defaultTokenURL(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := runLoad(target, tokenURL)
+	if res.ConnectionErrors != 0 {
+		t.Errorf("connection errors = %d, want 0", res.ConnectionErrors)
+	}
+	if res.MessagesSent == 0 || res.MessagesReceived == 0 {
+		t.Errorf("sent %d, received %d, want both above 0", res.MessagesSent, res.MessagesReceived)
+	}
+	if res.Throughput <= 0 {
+		t.Errorf("throughput = %v, want above 0", res.Throughput)
+	}
+}
+
+func TestDefaultTokenURL(t *testing.T) {
+	for target, want := range map[string]string{
+		"ws://localhost:8025/ws":        "http://localhost:8025/api/auth/token",
+		"wss://chat.example.com/ws?x=1": "https://chat.example.com/api/auth/token",
+	} {
+		if got, err := defaultTokenURL(target); err != nil || got != want {
+			t.Errorf("defaultTokenURL(%q) = %q, %v, want %q", target, got, err, want)
+		}
+	}
+	if _, err := defaultTokenURL("http://localhost/ws"); err == nil {
+		t.Error("defaultTokenURL accepted an http target")
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+const (
+	// Number of shards of the deny-list.
+	denyListShards = 64
+
+	// How often each shard is scanned for expired entries. Shards are scanned
+	// one at a time, spread evenly over the interval.
+	denyListPruneInterval = time.Minute
+)
+
+// ShardedDenyList holds the IDs of revoked tokens until the tokens would
+// have expired anyway. Entries are spread over several maps by the hash of
+// their ID, so that lookups and revocations of different tokens rarely
+// contend.
+type ShardedDenyList struct {
+	// Each shard maps jti to the time the entry may be forgotten.
+	shards []sync.Map
+}
+
+func newShardedDenyList(n int) *ShardedDenyList {
+	return &ShardedDenyList{shards: make([]sync.Map, n)}
+}
+
+func (d *ShardedDenyList) shard(jti string) *sync.Map {
+	h := fnv.New32a()
+	h.Write([]byte(jti))
+	return &d.shards[h.Sum32()%uint32(len(d.shards))]
+}
+
+// Add revokes jti until expiry.
+func (d *ShardedDenyList) Add(jti string, expiry time.Time) {
+	d.shard(jti).Store(jti, expiry)
+}
+
+// Contains reports whether jti has been revoked and has not yet expired.
+func (d *ShardedDenyList) Contains(jti string) bool {
+	v, ok := d.shard(jti).Load(jti)
+	if !ok {
+		return false
+	}
+	return time.Now().Before(v.(time.Time))
+}
+
+// run drops entries whose tokens have expired, scanning one shard per tick.
+func (d *ShardedDenyList) run() {
+	ticker := time.NewTicker(denyListPruneInterval / time.Duration(len(d.shards)))
+	defer ticker.Stop()
+	next := 0
+	for now := range ticker.C {
+		d.prune(next, now)
+		next = (next + 1) % len(d.shards)
+	}
+}
+
+// prune drops the entries of shard i that expired before now.
+func (d *ShardedDenyList) prune(i int, now time.Time) {
+	shard := &d.shards[i]
+	shard.Range(func(k, v any) bool {
+		if now.After(v.(time.Time)) {
+			shard.Delete(k)
+		}
+		return true
+	})
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestShardedDenyList(t *testing.T) {
+	d := newShardedDenyList(denyListShards)
+	now := time.Now()
+	d.Add("live", now.Add(time.Hour))
+	d.Add("expired", now.Add(-time.Second))
+
+	if !d.Contains("live") {
+		t.Error("live entry not contained")
+	}
+	if d.Contains("expired") {
+		t.Error("expired entry still contained")
+	}
+	if d.Contains("unknown") {
+		t.Error("unknown entry contained")
+	}
+
+	for i := range d.shards {
+		d.prune(i, now)
+	}
+	if _, ok := d.shard("expired").Load("expired"); ok {
+		t.Error("expired entry not pruned")
+	}
+	if _, ok := d.shard("live").Load("live"); !ok {
+		t.Error("live entry pruned")
+	}
+}
+
+// BenchmarkShardedDenyList measures Contains while other goroutines revoke
+// tokens, against a single shard as the baseline of one sync.Map.
+func BenchmarkShardedDenyList(b *testing.B) {
+	jtis := make([]string, 10000)
+	for i := range jtis {
+		jtis[i] = "jti-" + strconv.Itoa(i)
+	}
+	for _, shards := range []int{1, denyListShards} {
+		b.Run("shards="+strconv.Itoa(shards), func(b *testing.B) {
+			d := newShardedDenyList(shards)
+			expiry := time.Now().Add(time.Hour)
+			for _, jti := range jtis[:len(jtis)/2] {
+				d.Add(jti, expiry)
+			}
+			b.RunParallel(func(pb *testing.PB) {
+				for i := 0; pb.Next(); i++ {
+					// One revocation for every 16 lookups.
+					jti := jtis[i%len(jtis)]
+					if i%16 == 0 {
+						d.Add(jti, expiry)
+					} else {
+						d.Contains(jti)
+					}
+				}
+			})
+		})
+	}
+}
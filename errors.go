@@ -0,0 +1,43 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+)
+
+// Codes carried by AuthError.
+const (
+	authMissingToken     = "missing_token"
+	authInvalidToken     = "invalid_token"
+	authTokenRevoked     = "token_revoked"
+	authClaimsRejected   = "claims_rejected"
+	authTenantNotAllowed = "tenant_not_allowed"
+)
+
+// AuthError reports why a request could not be authenticated.
+type AuthError struct {
+	Code    string
+	Message string
+	Cause   error
+}
+
+func (e *AuthError) Error() string {
+	if e.Cause != nil {
+		return e.Message + ": " + e.Cause.Error()
+	}
+	return e.Message
+}
+
+func (e *AuthError) Unwrap() error {
+	return e.Cause
+}
+
+// errorStatus maps an error returned by the auth code to the HTTP
+// status a handler should respond with.
+func errorStatus(err error) int {
+	var authErr *AuthError
+	if errors.As(err, &authErr) {
+		return http.StatusUnauthorized
+	}
+	return http.StatusInternalServerError
+}
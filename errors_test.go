@@ -0,0 +1,44 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestAuthErrorUnwrap(t *testing.T) {
+	cause := errors.New("signature is invalid")
+	err := fmt.Errorf("upgrade: %w", &AuthError{Code: authInvalidToken, Message: "Invalid token", Cause: cause})
+
+	if !errors.Is(err, cause) {
+		t.Error("errors.Is does not find the cause")
+	}
+	var authErr *AuthError
+	if !errors.As(err, &authErr) {
+		t.Fatal("errors.As does not find the AuthError")
+	}
+	if authErr.Code != authInvalidToken {
+		t.Errorf("Code = %q, want %q", authErr.Code, authInvalidToken)
+	}
+	if got, want := authErr.Error(), "Invalid token: signature is invalid"; got != want {
+		t.Errorf("Error() = %q, want %q", got, want)
+	}
+}
+
+func TestErrorStatus(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{"auth error", &AuthError{Code: authMissingToken, Message: "Missing token"}, http.StatusUnauthorized},
+		{"wrapped auth error", fmt.Errorf("wrapped: %w", &AuthError{Code: authTokenRevoked}), http.StatusUnauthorized},
+		{"other error", errors.New("disk full"), http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		if got := errorStatus(tt.err); got != tt.want {
+			t.Errorf("%s: errorStatus = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
@@ -4,4 +4,9 @@ go 1.25.3
 
 require github.com/gorilla/websocket v1.5.3
 
-require github.com/golang-jwt/jwt/v5 v5.3.0 // indirect
+require (
+	github.com/coreos/go-systemd/v22 v22.7.0
+	github.com/golang-jwt/jwt/v5 v5.3.0
+	golang.org/x/net v0.47.0
+	golang.org/x/time v0.14.0
+)
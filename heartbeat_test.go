@@ -0,0 +1,57 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestHeartbeatTimeoutCloses4006(t *testing.T) {
+	srv, tenants := newTestServer(t)
+	tenants.heartbeatTimeout = 200 * time.Millisecond
+	conn := dialTest(t, srv, newTestToken(t, "guest-a", ""))
+
+	start := time.Now()
+	if code := readCloseCode(t, conn, 2*time.Second); code != closeHeartbeatTimeout {
+		t.Fatalf("close code = %d, want %d", code, closeHeartbeatTimeout)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("closed after %v, before the timeout", elapsed)
+	}
+}
+
+func TestHeartbeatKeepsClientConnected(t *testing.T) {
+	srv, tenants := newTestServer(t)
+	tenants.heartbeatTimeout = 1500 * time.Millisecond
+	conn := dialTest(t, srv, newTestToken(t, "guest-a", ""))
+
+	for range 2 {
+		time.Sleep(time.Second)
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(heartbeatMessage)); err != nil {
+			t.Fatal(err)
+		}
+		if got := readText(t, conn); !strings.HasPrefix(got, heartbeatAckPrefix) {
+			t.Fatalf("reply = %q, want %s", got, heartbeatAckPrefix)
+		}
+	}
+}
+
+func TestHeartbeatFloodIsDropped(t *testing.T) {
+	srv, _ := newTestServer(t)
+	conn := dialTest(t, srv, newTestToken(t, "guest-a", ""))
+
+	for range 50 {
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(heartbeatMessage)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := readText(t, conn); !strings.HasPrefix(got, heartbeatAckPrefix) {
+		t.Fatalf("reply = %q, want %s", got, heartbeatAckPrefix)
+	}
+	conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, message, err := conn.ReadMessage(); err == nil {
+		t.Errorf("got %q, want a single ack", message)
+	}
+}
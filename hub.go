@@ -4,12 +4,33 @@
 
 package main
 
+import (
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// How often the hub looks for clients whose heartbeat has timed out, at
+// most. Shorter timeouts are checked twice per timeout.
+const heartbeatCheckPeriod = 10 * time.Second
+
 // Message represents a message with its sender
 type Message struct {
 	sender *Client
 	data   []byte
 }
 
+// muteRequest asks the hub to mute the clients named name until the given
+// time. A zero time unmutes them. The hub reports on found whether there
+// were any.
+type muteRequest struct {
+	name  string
+	until time.Time
+	found chan bool
+}
+
 // Hub maintains the set of active clients and broadcasts messages to the
 // clients.
 type Hub struct {
@@ -24,6 +45,49 @@ type Hub struct {
 
 	// Unregister requests from clients.
 	unregister chan *Client
+
+	// Token IDs revoked by the logout endpoint.
+	revoke chan string
+
+	// Messages addressed to their sender only, such as error notifications.
+	notify chan *Message
+
+	// Clients that sent an application-level heartbeat.
+	heartbeat chan *Client
+
+	// Requests for a snapshot of the registered clients.
+	list chan chan []ClientInfo
+
+	// Requests to mute or unmute clients.
+	mute chan *muteRequest
+
+	// Messages from the server to all clients.
+	announce chan []byte
+
+	// Close frames to disconnect all clients with.
+	closeAll chan []byte
+
+	// Reflect each message back to its sender instead of broadcasting it.
+	echo bool
+
+	// ID of the tenant the hub serves, and the tap its events are mirrored
+	// to, if any.
+	tenantID string
+	tap      *Tap
+
+	// Disconnect clients that have not sent a heartbeat for this long. Zero
+	// disables the check.
+	heartbeatTimeout time.Duration
+
+	// Number of clients registered through the TenantHub and not yet
+	// unregistered, guarded by its lock. The hub is stopped, by closing
+	// stop, when this drops to zero.
+	refs int
+	stop chan struct{}
+
+	// Counters for monitoring, readable from any goroutine.
+	numClients  atomic.Int64
+	numMessages atomic.Int64
 }
 
 func newHub() *Hub {
@@ -31,33 +95,174 @@ func newHub() *Hub {
 		broadcast:  make(chan *Message),
 		register:   make(chan *Client),
 		unregister: make(chan *Client),
+		revoke:     make(chan string),
+		notify:     make(chan *Message),
+		heartbeat:  make(chan *Client),
+		list:       make(chan chan []ClientInfo),
+		mute:       make(chan *muteRequest),
+		announce:   make(chan []byte),
+		closeAll:   make(chan []byte),
+		stop:       make(chan struct{}),
 		clients:    make(map[*Client]bool),
 	}
 }
 
 func (h *Hub) run() {
+	var heartbeatCheck <-chan time.Time
+	if h.heartbeatTimeout > 0 {
+		ticker := time.NewTicker(min(heartbeatCheckPeriod, h.heartbeatTimeout/2))
+		defer ticker.Stop()
+		heartbeatCheck = ticker.C
+	}
+
 	for {
 		select {
+		case <-h.stop:
+			return
 		case client := <-h.register:
-			h.clients[client] = true
+			if client.anonymous && h.countAnonymous() >= maxAnonymousClients {
+				h.disconnect(client, closeAnonymousLimit, "too many anonymous clients")
+			} else {
+				client.lastHeartbeat = time.Now()
+				h.clients[client] = true
+				h.tap.publish(TapEvent{Type: "register", TenantID: h.tenantID, Client: client.name})
+			}
 		case client := <-h.unregister:
 			if _, ok := h.clients[client]; ok {
 				delete(h.clients, client)
 				close(client.send)
 			}
-		case message := <-h.broadcast:
+			// Sent exactly once per client, even if the hub dropped it
+			// before.
+			h.tap.publish(TapEvent{Type: "unregister", TenantID: h.tenantID, Client: client.name})
+		case jti := <-h.revoke:
 			for client := range h.clients {
-				// Skip sending message back to the sender
-				if client.name == message.sender.name {
-					continue
+				if client.jti == jti {
+					h.disconnect(client, closeTokenRevoked, "token revoked")
 				}
-				select {
-				case client.send <- message.data:
-				default:
-					close(client.send)
-					delete(h.clients, client)
+			}
+		case message := <-h.notify:
+			h.sendTo(message.sender, message.data)
+		case client := <-h.heartbeat:
+			now := time.Now()
+			client.lastHeartbeat = now
+			h.sendTo(client, []byte(heartbeatAckPrefix+strconv.FormatInt(now.Unix(), 10)))
+		case reply := <-h.list:
+			reply <- h.listClients()
+		case req := <-h.mute:
+			req.found <- h.muteClients(req.name, req.until)
+		case data := <-h.announce:
+			for client := range h.clients {
+				h.sendTo(client, data)
+			}
+		case closeMsg := <-h.closeAll:
+			for client := range h.clients {
+				client.closeMsg = closeMsg
+				delete(h.clients, client)
+				close(client.send)
+			}
+		case now := <-heartbeatCheck:
+			for client := range h.clients {
+				if now.Sub(client.lastHeartbeat) > h.heartbeatTimeout {
+					h.disconnect(client, closeHeartbeatTimeout, "heartbeat timeout")
 				}
 			}
+		case message := <-h.broadcast:
+			switch {
+			case time.Now().Before(message.sender.mutedUntil):
+				h.sendTo(message.sender, []byte(errorPrefix+"muted:"+strconv.FormatInt(message.sender.mutedUntil.Unix(), 10)))
+			case h.echo:
+				h.numMessages.Add(1)
+				h.tap.publish(TapEvent{Type: "broadcast", TenantID: h.tenantID, Client: message.sender.name, Data: string(message.data)})
+				h.sendTo(message.sender, append([]byte(echoPrefix), message.data...))
+			default:
+				h.numMessages.Add(1)
+				h.tap.publish(TapEvent{Type: "broadcast", TenantID: h.tenantID, Client: message.sender.name, Data: string(message.data)})
+				h.broadcastMessage(message)
+			}
+		}
+		h.numClients.Store(int64(len(h.clients)))
+	}
+}
+
+// broadcastMessage delivers message to every client except its sender.
+func (h *Hub) broadcastMessage(message *Message) {
+	for client := range h.clients {
+		// Skip sending message back to the sender
+		if client.name == message.sender.name {
+			continue
+		}
+		select {
+		case client.send <- message.data:
+		default:
+			close(client.send)
+			delete(h.clients, client)
 		}
 	}
 }
+
+// listClients describes the registered clients.
+func (h *Hub) listClients() []ClientInfo {
+	infos := make([]ClientInfo, 0, len(h.clients))
+	for client := range h.clients {
+		infos = append(infos, ClientInfo{
+			Name:           client.name,
+			Tier:           client.tier,
+			Anonymous:      client.anonymous,
+			ConnectedSince: client.connectedAt.Unix(),
+			EMARate:        client.emaRate(),
+			jti:            client.jti,
+		})
+	}
+	return infos
+}
+
+// muteClients mutes the clients named name until until, or unmutes them if
+// it is zero, and tells them so. It reports whether there were any.
+func (h *Hub) muteClients(name string, until time.Time) bool {
+	notice := []byte(mutedPrefix + "0")
+	if !until.IsZero() {
+		notice = []byte(mutedPrefix + strconv.FormatInt(until.Unix(), 10))
+	}
+	found := false
+	for client := range h.clients {
+		if client.name == name {
+			client.mutedUntil = until
+			h.sendTo(client, notice)
+			found = true
+		}
+	}
+	return found
+}
+
+// countAnonymous returns the number of registered anonymous clients.
+func (h *Hub) countAnonymous() int {
+	n := 0
+	for client := range h.clients {
+		if client.anonymous {
+			n++
+		}
+	}
+	return n
+}
+
+// sendTo queues data for a single client, if it is still registered.
+func (h *Hub) sendTo(client *Client, data []byte) {
+	if _, ok := h.clients[client]; !ok {
+		return
+	}
+	select {
+	case client.send <- data:
+	default:
+		close(client.send)
+		delete(h.clients, client)
+	}
+}
+
+// disconnect removes client from the hub and has its writePump send a close
+// frame with the given code before hanging up.
+func (h *Hub) disconnect(client *Client, code int, text string) {
+	client.closeMsg = websocket.FormatCloseMessage(code, text)
+	delete(h.clients, client)
+	close(client.send)
+}
@@ -0,0 +1,21 @@
+package main
+
+import "testing"
+
+func TestEchoModeRepliesOnlyToSender(t *testing.T) {
+	srv, tenants := newTestServer(t)
+	tenants.echo = true
+	alice := dialTest(t, srv, newTestToken(t, "alice", ""))
+	bob := dialTest(t, srv, newTestToken(t, "bob", ""))
+
+	if got, want := chatReply(t, alice, "hello"), echoPrefix+"alice: hello"; got != want {
+		t.Errorf("alice got %q, want %q", got, want)
+	}
+	// Had alice's message reached bob, it would arrive before bob's own echo.
+	if got, want := chatReply(t, bob, "hi"), echoPrefix+"bob: hi"; got != want {
+		t.Errorf("bob got %q, want only their own echo %q", got, want)
+	}
+	if got, want := chatReply(t, alice, "again"), echoPrefix+"alice: again"; got != want {
+		t.Errorf("alice got %q, want only their own echo %q", got, want)
+	}
+}
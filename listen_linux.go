@@ -0,0 +1,33 @@
+//go:build linux
+
+package main
+
+import (
+	"log"
+	"net"
+
+	"github.com/coreos/go-systemd/v22/activation"
+)
+
+// listen returns the socket passed by systemd socket activation, if any, and
+// otherwise listens on addr. With socket activation systemd keeps accepting
+// connections while the server restarts, so none are refused.
+func listen(addr string) (net.Listener, error) {
+	listeners, err := activation.Listeners()
+	if err != nil {
+		return nil, err
+	}
+	switch len(listeners) {
+	case 0:
+		return net.Listen("tcp", addr)
+	case 1:
+		log.Printf("Using socket passed by systemd: %s", listeners[0].Addr())
+		return listeners[0], nil
+	default:
+		for _, l := range listeners[1:] {
+			l.Close()
+		}
+		log.Printf("systemd passed %d sockets, using the first: %s", len(listeners), listeners[0].Addr())
+		return listeners[0], nil
+	}
+}
@@ -0,0 +1,56 @@
+//go:build linux
+
+package main
+
+import (
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"testing"
+)
+
+// TestListenSocketActivation runs the test binary again with a listening
+// socket as fd 3, the way systemd passes it, and checks that listen returns
+// that socket. A child process is needed because LISTEN_PID must name the
+// process and fd 3 is not free to take over in this one.
+func TestListenSocketActivation(t *testing.T) {
+	if addr := os.Getenv("LISTEN_TEST_ADDR"); addr != "" {
+		os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+		ln, err := listen(":0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+		if got := ln.Addr().String(); got != addr {
+			t.Fatalf("listen returned %s, want the passed socket %s", got, addr)
+		}
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+		if _, err := ln.Accept(); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	f, err := ln.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestListenSocketActivation$")
+	cmd.Env = append(os.Environ(), "LISTEN_FDS=1", "LISTEN_TEST_ADDR="+ln.Addr().String())
+	cmd.ExtraFiles = []*os.File{f}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("child: %v\n%s", err, out)
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "net"
+
+// listen listens on addr. Socket activation is only supported on Linux.
+func listen(addr string) (net.Listener, error) {
+	return net.Listen("tcp", addr)
+}
@@ -5,16 +5,66 @@
 package main
 
 import (
+	_ "embed"
 	"flag"
+	"html/template"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 )
 
 var addr = flag.String("addr", ":8025", "http service address")
 
+var echoMode = flag.Bool("echo-mode", false, "send each message back to its sender instead of broadcasting it (for testing)")
+
+var writeRateLimit = flag.Int("write-rate", 50, "maximum messages per second written to each client (0 for no limit)")
+
+// The Vue build used by the chat page compiles its templates at runtime,
+// which needs 'unsafe-eval'; Tailwind injects its styles inline.
+var csp = flag.String("csp", "default-src 'self'; connect-src 'self' wss:; img-src 'self' data:; style-src 'self' 'unsafe-inline'; script-src 'self' 'unsafe-eval'",
+	"Content-Security-Policy for HTML responses; a per-request script nonce is added to script-src")
+
+var heartbeatTimeout = flag.Duration("heartbeat-timeout", 120*time.Second, "disconnect clients that send no HEARTBEAT message for this long (0 to disable)")
+
+var sanitizeMode = flag.String("sanitize-mode", "none", "how HTML in chat messages is treated before broadcast: none, escape or strip")
+
+var tokenRateLimit = flag.Int("token-rate-limit", 5, "maximum tokens issued per IP address per minute (0 for no limit)")
+
+var ipConnLimit = flag.Int("ip-conn-limit", 10, "maximum WebSocket connection attempts per IP address per minute (0 for no limit)")
+
+var ipBanAfter = flag.Int("ip-ban-after", 0, "ban an IP address for an hour once -ip-conn-limit has turned it away this many times in a row (0 to never ban)")
+
+var trustProxy = flag.Bool("trust-proxy", false, "take client IP addresses from the last X-Forwarded-For entry, as set by a reverse proxy such as the Heroku router")
+
+var adminToken = flag.String("admin-token", os.Getenv("ADMIN_TOKEN"), "token required by the admin endpoints (default $ADMIN_TOKEN); admin endpoints are disabled if empty")
+
+var tierGrantSecret = flag.String("tier-grant-secret", os.Getenv("TIER_GRANT_SECRET"), "secret required to request a token above the free tier (default $TIER_GRANT_SECRET)")
+
+var tenantGrantSecret = flag.String("tenant-grant-secret", os.Getenv("TENANT_GRANT_SECRET"), "secret required to request a token for a tenant other than the default one (default $TENANT_GRANT_SECRET)")
+
+var tapSocket = flag.String("tap-socket", "", "UNIX domain socket that mirrors hub events to passive observers as JSON lines")
+
+var allowedTenants = flag.String("allowed-tenants", "", "comma-separated tenants whose tokens are accepted (default all); an empty entry, as in \"acme,\", stands for the default tenant")
+
+var allowLazyAuth = flag.Bool("allow-lazy-auth", false, "accept WebSocket connections without a token that send AUTH:<jwt> as their first message")
+
+var allowAnonymous = flag.Bool("allow-anonymous", false, "accept WebSocket connections without a token as listen-only clients")
+
+// The chat page, embedded so the binary can run from any directory.
+//
+//go:embed home.html
+var homeHTML string
+
+// The chat page as a template, to inject the CSP nonce into its script
+// tags. Vue uses {{ }} in the page itself, hence the different delimiters.
+var homeTemplate = template.Must(template.New("home").Delims("[[", "]]").Parse(homeHTML))
+
 func serveHome(w http.ResponseWriter, r *http.Request) {
-	log.Println(r.URL)
+	log.Printf("request_id=%s %s", requestID(r.Context()), r.URL)
 	if r.URL.Path != "/" {
 		http.Error(w, "Not found", http.StatusNotFound)
 		return
@@ -23,11 +73,16 @@ func serveHome(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
-	http.ServeFile(w, r, "home.html")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	homeTemplate.Execute(w, struct{ Nonce string }{cspNonce(r.Context())})
 }
 
 func main() {
 	flag.Parse()
+	if _, ok := sanitizers[*sanitizeMode]; !ok {
+		log.Fatalf("invalid -sanitize-mode %q", *sanitizeMode)
+	}
 
 	// Use PORT environment variable if available (for Heroku)
 	port := os.Getenv("PORT")
@@ -38,17 +93,72 @@ func main() {
 		}
 	}
 
-	hub := newHub()
-	go hub.run()
+	if *allowedTenants != "" {
+		claimsValidator = TenantValidator{allowedTenants: strings.Split(*allowedTenants, ",")}
+	}
+
+	tenants := newTenantHub()
+	tenants.echo = *echoMode
+	tenants.heartbeatTimeout = *heartbeatTimeout
+	if *tapSocket != "" {
+		tap, err := newTap(*tapSocket)
+		if err != nil {
+			log.Fatal("Tap: ", err)
+		}
+		defer tap.Close()
+		go tap.run()
+		tenants.tap = tap
+	}
+	go jtiDenyList.run()
 	http.HandleFunc("/", serveHome)
+	if *tokenRateLimit > 0 {
+		tokenThrottle = newIPThrottle(*tokenRateLimit, time.Minute, 0, 0)
+		go tokenThrottle.run()
+	}
 	http.HandleFunc("/api/auth/token", handleGetToken)
-	http.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
-		serveWs(hub, w, r)
+	http.HandleFunc("/api/version", handleVersion)
+	http.HandleFunc("/api/auth/logout", func(w http.ResponseWriter, r *http.Request) {
+		handleLogout(tenants, w, r)
+	})
+	ws := func(w http.ResponseWriter, r *http.Request) {
+		serveWs(tenants, w, r)
+	}
+	if *ipConnLimit > 0 {
+		throttle := newIPThrottle(*ipConnLimit, time.Minute, *ipBanAfter, time.Hour)
+		go throttle.run()
+		ws = throttle.wrap(ws)
+	}
+	http.HandleFunc("/ws", ws)
+	http.HandleFunc("/api/me", func(w http.ResponseWriter, r *http.Request) {
+		handleMe(tenants, w, r)
+	})
+	http.HandleFunc("/api/clients", func(w http.ResponseWriter, r *http.Request) {
+		handleListClients(tenants, w, r)
+	})
+	http.HandleFunc("/api/clients/mute", func(w http.ResponseWriter, r *http.Request) {
+		handleMute(tenants, w, r)
+	})
+	http.HandleFunc("/lb-health", func(w http.ResponseWriter, r *http.Request) {
+		handleLBHealth(tenants, w, r)
+	})
+	http.HandleFunc("/admin/ws", func(w http.ResponseWriter, r *http.Request) {
+		serveAdminWs(tenants, w, r)
 	})
 
-	log.Printf("Server starting on port %s", port)
-	err := http.ListenAndServe(":"+port, nil)
+	ln, err := listen(":" + port)
 	if err != nil {
-		log.Fatal("ListenAndServe: ", err)
+		log.Fatal("Listen: ", err)
 	}
+	log.Printf("Server %s (protocol %s) starting on %s as %s", version, ProtocolVersion, ln.Addr(), nodeID)
+	srv := &http.Server{Handler: RequestIDMiddleware(ProtocolVersionMiddleware(CSPMiddleware(*csp, http.DefaultServeMux)))}
+	go func() {
+		if err := srv.Serve(ln); err != http.ErrServerClosed {
+			log.Fatal("Serve: ", err)
+		}
+	}()
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	log.Printf("Received %v", <-sig)
+	shutdown(srv, tenants)
 }
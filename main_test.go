@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// newTestServer serves the chat endpoints backed by a fresh TenantHub.
+// Settings of the TenantHub must be changed before the first client
+// connects.
+func newTestServer(t *testing.T) (*httptest.Server, *TenantHub) {
+	t.Helper()
+	tenants := newTenantHub()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/auth/logout", func(w http.ResponseWriter, r *http.Request) {
+		handleLogout(tenants, w, r)
+	})
+	mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+		serveWs(tenants, w, r)
+	})
+	mux.HandleFunc("/admin/ws", func(w http.ResponseWriter, r *http.Request) {
+		serveAdminWs(tenants, w, r)
+	})
+	srv := httptest.NewServer(RequestIDMiddleware(mux))
+	t.Cleanup(srv.Close)
+	return srv, tenants
+}
+
+// newTestToken issues a token for the guest name in the given tenant.
+func newTestToken(t *testing.T, name, tenantID string) string {
+	t.Helper()
+	token, _, err := generateGuestToken(name, tenantID, defaultTier)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// dialTest opens a WebSocket connection to srv with token, which may be
+// empty, and consumes the IDENTITY message of authenticated connections.
+func dialTest(t *testing.T, srv *httptest.Server, token string) *websocket.Conn {
+	t.Helper()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws"
+	if token != "" {
+		url += "?token=" + token
+	}
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if token != "" {
+		if got := readText(t, conn); !strings.HasPrefix(got, "IDENTITY:") {
+			t.Fatalf("first message = %q, want IDENTITY", got)
+		}
+	}
+	return conn
+}
+
+// readText reads the next text message from conn, failing the test if none
+// arrives within a second.
+func readText(t *testing.T, conn *websocket.Conn) string {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, message, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(message)
+}
+
+// readCloseCode reads from conn until the server closes it and returns the
+// close code.
+func readCloseCode(t *testing.T, conn *websocket.Conn, timeout time.Duration) int {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	for {
+		_, _, err := conn.ReadMessage()
+		if err == nil {
+			continue
+		}
+		var closeErr *websocket.CloseError
+		if !errors.As(err, &closeErr) {
+			t.Fatalf("read error = %v, want a close frame", err)
+		}
+		return closeErr.Code
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+const requestIDHeader = "X-Request-ID"
+
+// Header naming the tenant an admin API request is about. Required by the
+// admin endpoints alongside the admin token; an empty value names the
+// default tenant.
+const tenantIDHeader = "X-Tenant-ID"
+
+// Content-Security-Policy for API responses, which are never rendered.
+const apiCSP = "default-src 'none'"
+
+// Matches the canonical textual form of a UUID.
+var uuidPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+type requestIDKey struct{}
+
+type cspNonceKey struct{}
+
+// RequestIDMiddleware tags every request with an ID, taken from the incoming
+// X-Request-ID header if it is a UUID and generated otherwise. The ID is
+// stored in the request context and echoed in the response header.
+func RequestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !uuidPattern.MatchString(id) {
+			id = newUUID()
+		}
+		w.Header().Set(requestIDHeader, id)
+		ctx := context.WithValue(r.Context(), requestIDKey{}, id)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// requestID returns the ID assigned to the request by RequestIDMiddleware.
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// newUUID returns a random (version 4) UUID.
+func newUUID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// CSPMiddleware sets a Content-Security-Policy header on every response
+// except WebSocket upgrades. API and health check responses get apiCSP;
+// everything else is treated as HTML and gets policy with a per-request nonce
+// added to its script-src directive. Handlers read the nonce with cspNonce.
+func CSPMiddleware(policy string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case websocket.IsWebSocketUpgrade(r):
+		case strings.HasPrefix(r.URL.Path, "/api/") || r.URL.Path == "/lb-health":
+			w.Header().Set("Content-Security-Policy", apiCSP)
+		default:
+			nonce := newNonce()
+			w.Header().Set("Content-Security-Policy", withNonce(policy, nonce))
+			r = r.WithContext(context.WithValue(r.Context(), cspNonceKey{}, nonce))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// cspNonce returns the script nonce assigned to the request by CSPMiddleware.
+func cspNonce(ctx context.Context) string {
+	nonce, _ := ctx.Value(cspNonceKey{}).(string)
+	return nonce
+}
+
+// withNonce adds nonce to the script-src directive of policy, or appends a
+// script-src directive allowing only that nonce if there is none.
+func withNonce(policy, nonce string) string {
+	source := "'nonce-" + nonce + "'"
+	directives := strings.Split(policy, ";")
+	for i, d := range directives {
+		if fields := strings.Fields(d); len(fields) > 0 && fields[0] == "script-src" {
+			directives[i] = strings.TrimRight(d, " ") + " " + source
+			return strings.Join(directives, ";")
+		}
+	}
+	return strings.TrimRight(policy, "; ") + "; script-src " + source
+}
+
+// newNonce returns a random value for a CSP nonce.
+func newNonce() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return base64.StdEncoding.EncodeToString(b[:])
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"html"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestRequestIDMiddleware(t *testing.T) {
+	const valid = "123e4567-e89b-42d3-a456-426614174000"
+	tests := []struct {
+		name     string
+		incoming string
+		keep     bool
+	}{
+		{"none", "", false},
+		{"valid", valid, true},
+		{"invalid", "not-a-uuid; drop table", false},
+	}
+	for _, tt := range tests {
+		var seen string
+		h := RequestIDMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			seen = requestID(r.Context())
+		}))
+		r := httptest.NewRequest("GET", "/", nil)
+		if tt.incoming != "" {
+			r.Header.Set(requestIDHeader, tt.incoming)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+
+		got := w.Header().Get(requestIDHeader)
+		if !uuidPattern.MatchString(got) {
+			t.Errorf("%s: %s = %q, want a UUID", tt.name, requestIDHeader, got)
+		}
+		if seen != got {
+			t.Errorf("%s: context ID %q, header %q", tt.name, seen, got)
+		}
+		if tt.keep && got != tt.incoming {
+			t.Errorf("%s: ID = %q, want incoming %q kept", tt.name, got, tt.incoming)
+		}
+		if !tt.keep && got == tt.incoming {
+			t.Errorf("%s: incoming ID %q not replaced", tt.name, got)
+		}
+	}
+}
+
+func TestCSPMiddleware(t *testing.T) {
+	tenants := newTenantHub()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", serveHome)
+	mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+		serveWs(tenants, w, r)
+	})
+	mux.HandleFunc("/lb-health", func(w http.ResponseWriter, r *http.Request) {
+		handleLBHealth(tenants, w, r)
+	})
+	srv := httptest.NewServer(CSPMiddleware("default-src 'self'", mux))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	policy := resp.Header.Get("Content-Security-Policy")
+	nonce, ok := strings.CutPrefix(policy, "default-src 'self'; script-src 'nonce-")
+	if !ok {
+		t.Fatalf("GET / policy = %q, want one with a script nonce", policy)
+	}
+	nonce = strings.TrimSuffix(nonce, "'")
+	// The template escapes the nonce in the attribute, e.g. + as &#43;.
+	if !strings.Contains(html.UnescapeString(string(body)), `nonce="`+nonce+`"`) {
+		t.Errorf("page does not carry the nonce %q", nonce)
+	}
+
+	resp, err = http.Get(srv.URL + "/lb-health")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got := resp.Header.Get("Content-Security-Policy"); got != apiCSP {
+		t.Errorf("/lb-health policy = %q, want %q", got, apiCSP)
+	}
+
+	token := newTestToken(t, "alice", "")
+	conn, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws?token="+token, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if got, ok := resp.Header["Content-Security-Policy"]; ok {
+		t.Errorf("upgrade response has policy %q, want none", got)
+	}
+}
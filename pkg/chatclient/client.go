@@ -0,0 +1,306 @@
+// Package chatclient is a Go client for the chat server.
+//
+// A Client holds one WebSocket connection authenticated with a token from
+// the server's /api/auth/token endpoint. If the connection drops, the client
+// reconnects with exponential backoff and keeps delivering messages on the
+// same channel.
+package chatclient
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// Number of reconnection attempts before giving up.
+	maxReconnectAttempts = 5
+
+	// Delay before the first reconnection attempt; doubled after each one.
+	initialBackoff = 500 * time.Millisecond
+
+	// How often a heartbeat is sent to keep the connection alive.
+	heartbeatPeriod = 30 * time.Second
+
+	// Close code the server uses when the token has been revoked.
+	closeTokenRevoked = 4004
+)
+
+// ErrClosed is returned by Send after Close has been called or the client
+// has given up reconnecting.
+var ErrClosed = errors.New("chatclient: client closed")
+
+// Message is a chat message relayed by the server.
+type Message struct {
+	// Name of the sender.
+	From string
+
+	Text string
+}
+
+// Client is a connection to the chat server.
+type Client struct {
+	url      string
+	messages chan Message
+	done     chan struct{}
+
+	// Guards conn and the fields below. Also serializes writes, as the
+	// websocket connection supports only one concurrent writer.
+	mu          sync.Mutex
+	conn        *websocket.Conn
+	name        string
+	closed      bool
+	onReconnect func()
+}
+
+// Dial connects to the websocket endpoint at rawURL, e.g.
+// ws://localhost:8025/ws, authenticating with token.
+func Dial(ctx context.Context, rawURL, token string) (*Client, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	q := u.Query()
+	q.Set("token", token)
+	u.RawQuery = q.Encode()
+
+	c := &Client{
+		url:      u.String(),
+		messages: make(chan Message, 256),
+		done:     make(chan struct{}),
+	}
+	if err := c.connect(ctx); err != nil {
+		return nil, err
+	}
+	go c.run()
+	return c, nil
+}
+
+// Name returns the guest name the server assigned to the client.
+func (c *Client) Name() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.name
+}
+
+// Messages returns the channel on which messages from other clients are
+// delivered. It is closed when the client is closed or gives up
+// reconnecting.
+func (c *Client) Messages() <-chan Message {
+	return c.messages
+}
+
+// SetOnReconnect registers f to be called each time the connection has been
+// re-established.
+func (c *Client) SetOnReconnect(f func()) {
+	c.mu.Lock()
+	c.onReconnect = f
+	c.mu.Unlock()
+}
+
+// Send sends a chat message. It fails if the client is not connected at the
+// moment, e.g. while reconnecting.
+func (c *Client) Send(ctx context.Context, text string) error {
+	return c.write(ctx, []byte(text))
+}
+
+// Close closes the connection and stops reconnecting. If the client has
+// already given up reconnecting, its connection is closed already.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	close(c.done)
+	conn := c.conn
+	c.mu.Unlock()
+
+	conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+		time.Now().Add(time.Second))
+	return conn.Close()
+}
+
+// connect dials the server and waits for it to send the client's identity.
+func (c *Client) connect(ctx context.Context) error {
+	conn, _, err := websocket.DefaultDialer.DialContext(ctx, c.url, nil)
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetReadDeadline(deadline)
+	}
+	_, message, err := conn.ReadMessage()
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	// The greeting may share a frame with messages queued after it.
+	greeting, rest, _ := bytes.Cut(message, []byte{'\n'})
+	name, ok := strings.CutPrefix(string(greeting), "IDENTITY:")
+	if !ok {
+		conn.Close()
+		return errors.New("chatclient: unexpected greeting from server")
+	}
+
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		conn.Close()
+		return ErrClosed
+	}
+	c.conn = conn
+	c.name = name
+	c.mu.Unlock()
+
+	c.deliver(rest)
+	return nil
+}
+
+// run reads from the connection until it fails, then reconnects, until the
+// client is closed or reconnecting fails.
+func (c *Client) run() {
+	defer close(c.messages)
+	for {
+		stop := make(chan struct{})
+		go c.heartbeat(stop)
+		err := c.read()
+		close(stop)
+
+		select {
+		case <-c.done:
+			return
+		default:
+		}
+
+		// The connection is of no further use, whether the client
+		// reconnects or gives up.
+		c.mu.Lock()
+		c.conn.Close()
+		c.mu.Unlock()
+
+		if websocket.IsCloseError(err, closeTokenRevoked) || !c.reconnect() {
+			c.mu.Lock()
+			c.closed = true
+			c.mu.Unlock()
+			return
+		}
+
+		c.mu.Lock()
+		f := c.onReconnect
+		c.mu.Unlock()
+		if f != nil {
+			f()
+		}
+	}
+}
+
+// read delivers messages from the current connection until it fails.
+func (c *Client) read() error {
+	c.mu.Lock()
+	conn := c.conn
+	c.mu.Unlock()
+	for {
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+		if !c.deliver(message) {
+			return ErrClosed
+		}
+	}
+}
+
+// deliver queues the chat messages in a frame from the server. It returns
+// false if the client was closed meanwhile.
+func (c *Client) deliver(frame []byte) bool {
+	for _, line := range bytes.Split(frame, []byte{'\n'}) {
+		if m, ok := parseMessage(string(line)); ok {
+			select {
+			case c.messages <- m:
+			case <-c.done:
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// reconnect tries to re-establish the connection with exponential backoff.
+func (c *Client) reconnect() bool {
+	backoff := initialBackoff
+	for attempt := 0; attempt < maxReconnectAttempts; attempt++ {
+		select {
+		case <-time.After(backoff):
+		case <-c.done:
+			return false
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		err := c.connect(ctx)
+		cancel()
+		if err == nil {
+			return true
+		}
+		backoff *= 2
+	}
+	return false
+}
+
+// heartbeat keeps the server from timing out the connection until stop is
+// closed.
+func (c *Client) heartbeat(stop <-chan struct{}) {
+	ticker := time.NewTicker(heartbeatPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			c.write(ctx, []byte("HEARTBEAT"))
+			cancel()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// write sends data as a text message on the current connection.
+func (c *Client) write(ctx context.Context, data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return ErrClosed
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(10 * time.Second)
+	}
+	c.conn.SetWriteDeadline(deadline)
+	return c.conn.WriteMessage(websocket.TextMessage, data)
+}
+
+// parseMessage parses a chat line of the form "<name>: <text>", as relayed by
+// the server. Control lines like HEARTBEAT_ACK:, ERROR: and MUTED: are
+// skipped.
+func parseMessage(line string) (Message, bool) {
+	line = strings.TrimPrefix(line, "ECHO:")
+	for _, prefix := range []string{"IDENTITY:", "HEARTBEAT_ACK:", "ERROR:", "MUTED:", "PROFILE_UPDATED:"} {
+		if strings.HasPrefix(line, prefix) {
+			return Message{}, false
+		}
+	}
+	from, text, ok := strings.Cut(line, ": ")
+	if !ok {
+		return Message{}, false
+	}
+	return Message{From: from, Text: text}, true
+}
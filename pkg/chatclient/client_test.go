@@ -0,0 +1,168 @@
+package chatclient
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestReconnectClosesOldConnection(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	oldClosed := make(chan error, 1)
+	first := true
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.WriteMessage(websocket.TextMessage, []byte("IDENTITY:guest-a"))
+		if !first {
+			conn.ReadMessage()
+			return
+		}
+		first = false
+
+		// Drop the client with a close frame, then wait for it to hang up.
+		conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseInternalServerErr, ""))
+		conn.ReadMessage()
+		raw := conn.NetConn()
+		raw.SetReadDeadline(time.Now().Add(2 * time.Second))
+		_, err = raw.Read(make([]byte, 1))
+		oldClosed <- err
+	}))
+	defer srv.Close()
+
+	c, err := Dial(context.Background(), "ws"+strings.TrimPrefix(srv.URL, "http"), "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := <-oldClosed; errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Error("old connection left open")
+	}
+}
+
+// relayServer starts a server that greets each connection as guest-a and
+// answers every message text with "bob: re: text", preceded by a control
+// line. The first drops connections are closed by the server right after
+// the greeting.
+func relayServer(t *testing.T, drops int32) string {
+	t.Helper()
+	upgrader := websocket.Upgrader{}
+	var conns atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.WriteMessage(websocket.TextMessage, []byte("IDENTITY:guest-a"))
+		if conns.Add(1) <= drops {
+			conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseServiceRestart, ""))
+			return
+		}
+		for {
+			_, message, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			conn.WriteMessage(websocket.TextMessage, []byte("HEARTBEAT_ACK:1\nbob: re: "+string(message)))
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return "ws" + strings.TrimPrefix(srv.URL, "http")
+}
+
+// receive returns the next message of c, failing the test if none arrives
+// within two seconds.
+func receive(t *testing.T, c *Client) Message {
+	t.Helper()
+	select {
+	case m, ok := <-c.Messages():
+		if !ok {
+			t.Fatal("Messages closed")
+		}
+		return m
+	case <-time.After(2 * time.Second):
+		t.Fatal("no message received")
+	}
+	return Message{}
+}
+
+func TestSendReceive(t *testing.T) {
+	ctx := context.Background()
+	c, err := Dial(ctx, relayServer(t, 0), "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if got := c.Name(); got != "guest-a" {
+		t.Errorf("Name = %q, want guest-a", got)
+	}
+
+	if err := c.Send(ctx, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := receive(t, c), (Message{From: "bob", Text: "re: hello"}); got != want {
+		t.Errorf("received %+v, want %+v", got, want)
+	}
+}
+
+func TestOnReconnectAfterServerClose(t *testing.T) {
+	ctx := context.Background()
+	c, err := Dial(ctx, relayServer(t, 1), "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	reconnected := make(chan struct{}, 1)
+	c.SetOnReconnect(func() { reconnected <- struct{}{} })
+
+	select {
+	case <-reconnected:
+	case <-time.After(3 * time.Second):
+		t.Fatal("OnReconnect not called after the server closed the connection")
+	}
+	if err := c.Send(ctx, "back"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := receive(t, c), (Message{From: "bob", Text: "re: back"}); got != want {
+		t.Errorf("received %+v after reconnecting, want %+v", got, want)
+	}
+}
+
+func TestClose(t *testing.T) {
+	ctx := context.Background()
+	c, err := Dial(ctx, relayServer(t, 0), "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Close(); err != nil {
+		t.Errorf("Close: %v", err)
+	}
+
+	select {
+	case m, ok := <-c.Messages():
+		if ok {
+			t.Errorf("received %+v after Close, want Messages closed", m)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("Messages not closed after Close")
+	}
+	if err := c.Send(ctx, "hello"); !errors.Is(err, ErrClosed) {
+		t.Errorf("Send after Close = %v, want ErrClosed", err)
+	}
+	if err := c.Close(); err != nil {
+		t.Errorf("second Close: %v", err)
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	// Maximum length of a profile's bio in bytes.
+	maxBioLength = 200
+
+	// Maximum size of a profile update request body.
+	maxProfileBodySize = 4096
+
+	// Maximum number of profiles kept in memory.
+	maxProfiles = 10000
+)
+
+// Prefix of the line broadcast to a tenant when a client updates its
+// profile. The rest of the line is a ProfileUpdate as JSON.
+const profileUpdatedPrefix = "PROFILE_UPDATED:"
+
+// ProfileMetadata is what a client tells others about itself.
+type ProfileMetadata struct {
+	AvatarURL string `json:"avatar_url,omitempty"`
+	Bio       string `json:"bio,omitempty"`
+}
+
+// ProfileUpdate is broadcast when a client changes its metadata.
+type ProfileUpdate struct {
+	Name     string          `json:"name"`
+	Metadata ProfileMetadata `json:"metadata"`
+}
+
+// ProfileResponse is the response of /api/me.
+type ProfileResponse struct {
+	Name     string          `json:"name"`
+	TenantID string          `json:"tenant_id,omitempty"`
+	Tier     string          `json:"tier"`
+	Metadata ProfileMetadata `json:"metadata"`
+
+	// Unix time the guest's oldest open connection was established, or zero
+	// when it has none.
+	ConnectedSince int64 `json:"connected_since"`
+}
+
+// ProfileStore keeps the metadata of guests, keyed by the ID of the token
+// they were issued. Guest names are short and may repeat, so they cannot
+// tell guests apart.
+type ProfileStore interface {
+	Get(jti string) ProfileMetadata
+
+	// Set stores metadata until expiry, when the token expires and nobody
+	// can ask for it anymore.
+	Set(jti string, metadata ProfileMetadata, expiry time.Time)
+}
+
+// storedProfile is an entry of memoryProfileStore.
+type storedProfile struct {
+	metadata ProfileMetadata
+	expiry   time.Time
+}
+
+// memoryProfileStore is a ProfileStore that forgets everything on restart.
+// It holds at most maxProfiles entries; when it is full, expired entries are
+// dropped first, then the one closest to expiring.
+type memoryProfileStore struct {
+	mu       sync.Mutex
+	profiles map[string]storedProfile
+}
+
+func newMemoryProfileStore() *memoryProfileStore {
+	return &memoryProfileStore{profiles: make(map[string]storedProfile)}
+}
+
+func (s *memoryProfileStore) Get(jti string) ProfileMetadata {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.profiles[jti]
+	if !ok || time.Now().After(p.expiry) {
+		return ProfileMetadata{}
+	}
+	return p.metadata
+}
+
+func (s *memoryProfileStore) Set(jti string, metadata ProfileMetadata, expiry time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.profiles[jti]; !ok && len(s.profiles) >= maxProfiles {
+		s.evict(time.Now())
+	}
+	s.profiles[jti] = storedProfile{metadata: metadata, expiry: expiry}
+}
+
+// evict drops the expired entries and, if that frees no room, the one
+// closest to expiring. s.mu must be held.
+func (s *memoryProfileStore) evict(now time.Time) {
+	var oldest string
+	for jti, p := range s.profiles {
+		if now.After(p.expiry) {
+			delete(s.profiles, jti)
+		} else if oldest == "" || p.expiry.Before(s.profiles[oldest].expiry) {
+			oldest = jti
+		}
+	}
+	if len(s.profiles) >= maxProfiles {
+		delete(s.profiles, oldest)
+	}
+}
+
+var profiles ProfileStore = newMemoryProfileStore()
+
+// validate reports what is wrong with m, if anything.
+func (m ProfileMetadata) validate() string {
+	if m.AvatarURL != "" {
+		u, err := url.Parse(m.AvatarURL)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return "avatar_url must be an http or https URL"
+		}
+	}
+	if len(m.Bio) > maxBioLength {
+		return "bio must be at most 200 bytes"
+	}
+	return ""
+}
+
+// handleMe returns the profile of the guest a Bearer token belongs to on GET,
+// and updates its metadata on PATCH. Updates are broadcast to the guest's
+// tenant so other clients can refresh it.
+func handleMe(tenants *TenantHub, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPatch {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Method not allowed"})
+		return
+	}
+
+	token, ok := bearerToken(r)
+	if !ok {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: "Missing bearer token"})
+		return
+	}
+
+	claims, err := validateToken(token)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(errorStatus(err))
+		json.NewEncoder(w).Encode(ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	if r.Method == http.MethodPatch {
+		// Tokens issued before jti was added have nothing to key a
+		// profile by.
+		if claims.ID == "" {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(ErrorResponse{Error: "Token cannot hold a profile"})
+			return
+		}
+		var body struct {
+			Metadata ProfileMetadata `json:"metadata"`
+		}
+		dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxProfileBodySize))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&body); err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(ErrorResponse{Error: "Invalid request body"})
+			return
+		}
+		if msg := body.Metadata.validate(); msg != "" {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(ErrorResponse{Error: msg})
+			return
+		}
+		expiry := time.Now().Add(tokenLifetime)
+		if claims.ExpiresAt != nil {
+			expiry = claims.ExpiresAt.Time
+		}
+		profiles.Set(claims.ID, body.Metadata, expiry)
+		update, _ := json.Marshal(ProfileUpdate{Name: claims.GuestName, Metadata: body.Metadata})
+		tenants.announce(claims.TenantID, append([]byte(profileUpdatedPrefix), update...))
+	}
+
+	resp := ProfileResponse{
+		Name:     claims.GuestName,
+		TenantID: claims.TenantID,
+		Tier:     effectiveTier(claims.Tier),
+	}
+	if claims.ID != "" {
+		resp.Metadata = profiles.Get(claims.ID)
+		for _, info := range tenants.clientsOf(claims.TenantID) {
+			if info.jti == claims.ID && (resp.ConnectedSince == 0 || info.ConnectedSince < resp.ConnectedSince) {
+				resp.ConnectedSince = info.ConnectedSince
+			}
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestMemoryProfileStoreExpires(t *testing.T) {
+	s := newMemoryProfileStore()
+	s.Set("expired", ProfileMetadata{Bio: "old"}, time.Now().Add(-time.Second))
+	s.Set("live", ProfileMetadata{Bio: "new"}, time.Now().Add(time.Hour))
+
+	if got := s.Get("expired"); got.Bio != "" {
+		t.Errorf("expired profile = %+v, want none", got)
+	}
+	if got := s.Get("live"); got.Bio != "new" {
+		t.Errorf("live profile = %+v, want bio new", got)
+	}
+}
+
+func TestMemoryProfileStoreIsBounded(t *testing.T) {
+	s := newMemoryProfileStore()
+	now := time.Now()
+	for i := range maxProfiles + 10 {
+		s.Set(strconv.Itoa(i), ProfileMetadata{}, now.Add(time.Hour+time.Duration(i)*time.Second))
+	}
+	if n := len(s.profiles); n != maxProfiles {
+		t.Errorf("store holds %d profiles, want %d", n, maxProfiles)
+	}
+	if _, ok := s.profiles["0"]; ok {
+		t.Error("profile closest to expiring was kept")
+	}
+}
+
+// meRequest calls handleMe with token as the Bearer token and body, if not
+// empty, as the request body.
+func meRequest(tenants *TenantHub, method, token, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, "/api/me", strings.NewReader(body))
+	r.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	handleMe(tenants, rec, r)
+	return rec
+}
+
+func TestHandleMeGet(t *testing.T) {
+	srv, tenants := newTestServer(t)
+	token := newTestToken(t, "alice", "acme")
+	dialTest(t, srv, token)
+
+	rec := meRequest(tenants, "GET", token, "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /api/me = %d %s", rec.Code, rec.Body)
+	}
+	var resp ProfileResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Name != "alice" || resp.TenantID != "acme" || resp.Tier != defaultTier {
+		t.Errorf("profile = %+v, want alice of acme on the %s tier", resp, defaultTier)
+	}
+	if resp.ConnectedSince == 0 {
+		t.Error("connected_since not set for a connected guest")
+	}
+
+	if rec := meRequest(tenants, "GET", "not-a-token", ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("GET with an invalid token = %d, want 401", rec.Code)
+	}
+}
+
+func TestHandleMePatchValidates(t *testing.T) {
+	tenants := newTenantHub()
+	token := newTestToken(t, "alice", "")
+	tests := []struct {
+		body string
+		want int
+	}{
+		{`{"metadata":{"avatar_url":"javascript:alert(1)"}}`, http.StatusBadRequest},
+		{`{"metadata":{"avatar_url":"ftp://example.com/a.png"}}`, http.StatusBadRequest},
+		{`{"metadata":{"bio":"` + strings.Repeat("a", maxBioLength+1) + `"}}`, http.StatusBadRequest},
+		{`{"metadata":{"avatar_url":"https://example.com/a.png","bio":"` + strings.Repeat("a", maxBioLength) + `"}}`, http.StatusOK},
+	}
+	for _, tt := range tests {
+		if rec := meRequest(tenants, "PATCH", token, tt.body); rec.Code != tt.want {
+			t.Errorf("PATCH %.60s = %d %s, want %d", tt.body, rec.Code, rec.Body, tt.want)
+		}
+	}
+}
+
+func TestHandleMePatchBroadcastsToTenant(t *testing.T) {
+	srv, tenants := newTestServer(t)
+	token := newTestToken(t, "alice", "acme")
+	alice := dialTest(t, srv, token)
+	bob := dialTest(t, srv, newTestToken(t, "bob", "acme"))
+	carol := dialTest(t, srv, newTestToken(t, "carol", "other"))
+	dave := dialTest(t, srv, newTestToken(t, "dave", "other"))
+
+	rec := meRequest(tenants, "PATCH", token, `{"metadata":{"bio":"hello"}}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("PATCH /api/me = %d %s", rec.Code, rec.Body)
+	}
+	want := profileUpdatedPrefix + `{"name":"alice","metadata":{"bio":"hello"}}`
+	for name, conn := range map[string]*websocket.Conn{"alice": alice, "bob": bob} {
+		if got := readText(t, conn); got != want {
+			t.Errorf("%s got %q, want %q", name, got, want)
+		}
+	}
+	// Had the update reached the other tenant, dave would read it first.
+	if err := carol.WriteMessage(websocket.TextMessage, []byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	if got := readText(t, dave); got != "carol: hi" {
+		t.Errorf("other tenant got %q, want only carol's message", got)
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"html"
+	"strings"
+
+	xhtml "golang.org/x/net/html"
+)
+
+// A Sanitizer rewrites the text of a chat message before it is broadcast.
+type Sanitizer func(text string) string
+
+// Sanitizers selectable with -sanitize-mode.
+var sanitizers = map[string]Sanitizer{
+	"none":   func(text string) string { return text },
+	"escape": html.EscapeString,
+	"strip":  stripTags,
+}
+
+// stripTags removes all HTML tags from text, keeping the text between them
+// as it was written. Entities are left alone, so "&lt;b&gt;" does not turn
+// into a tag.
+func stripTags(text string) string {
+	var b strings.Builder
+	z := xhtml.NewTokenizer(strings.NewReader(text))
+	for {
+		switch z.Next() {
+		case xhtml.ErrorToken:
+			return b.String()
+		case xhtml.TextToken:
+			b.Write(z.Raw())
+		}
+	}
+}
@@ -0,0 +1,21 @@
+package main
+
+import "testing"
+
+func TestSanitizers(t *testing.T) {
+	tests := []struct {
+		mode, text, want string
+	}{
+		{"none", "<script>alert(1)</script>", "<script>alert(1)</script>"},
+		{"escape", "<script>alert(1)</script>", "&lt;script&gt;alert(1)&lt;/script&gt;"},
+		{"strip", "<script>alert(1)</script>", "alert(1)"},
+		{"strip", "<b>bold</b> &lt;b&gt;", "bold &lt;b&gt;"},
+		{"escape", "hello, world", "hello, world"},
+		{"strip", "hello, world", "hello, world"},
+	}
+	for _, tt := range tests {
+		if got := sanitizers[tt.mode](tt.text); got != tt.want {
+			t.Errorf("%s(%q) = %q, want %q", tt.mode, tt.text, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// Time between starting to drain and closing the listener, so load
+	// balancers polling /lb-health take the node out of rotation first.
+	drainDelay = 5 * time.Second
+
+	// Time allowed for in-flight requests and close frames after that.
+	shutdownTimeout = 10 * time.Second
+)
+
+// Stable ID of this process, which load balancers can use to pin sessions to
+// it.
+var nodeID = "node-" + newUUID()
+
+// Set once the server has started shutting down.
+var draining atomic.Bool
+
+// Tracks the writePump of every connected client, so shutdown can wait for
+// their close frames to be written.
+var writePumps sync.WaitGroup
+
+// HealthResponse is the response of /lb-health.
+type HealthResponse struct {
+	Status             string `json:"status"`
+	SessionAffinityKey string `json:"session_affinity_key"`
+	Connections        int64  `json:"connections"`
+	Accepting          bool   `json:"accepting"`
+}
+
+// handleLBHealth reports whether the node accepts new connections. It
+// answers 503 once the server is draining.
+func handleLBHealth(tenants *TenantHub, w http.ResponseWriter, r *http.Request) {
+	clients, _, _ := tenants.stats()
+	resp := HealthResponse{
+		Status:             "ok",
+		SessionAffinityKey: nodeID,
+		Connections:        clients,
+		Accepting:          true,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if draining.Load() {
+		resp.Status, resp.Accepting = "draining", false
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+// shutdown drains the server: it fails health checks and refuses new
+// WebSocket connections, stops the HTTP server, and closes the connected
+// clients with 1001 (going away) so they reconnect to another node.
+func shutdown(srv *http.Server, tenants *TenantHub) {
+	draining.Store(true)
+	log.Printf("Draining, shutting down in %v", drainDelay)
+	time.Sleep(drainDelay)
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("Shutdown: %v", err)
+	}
+
+	// Hijacked WebSocket connections are not closed by Shutdown.
+	tenants.closeAll(websocket.CloseGoingAway, "server shutting down")
+	done := make(chan struct{})
+	go func() {
+		writePumps.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.Printf("Shutdown: timed out closing connections")
+	}
+}
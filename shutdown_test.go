@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// lbHealth calls handleLBHealth and decodes its response.
+func lbHealth(t *testing.T, tenants *TenantHub) (int, HealthResponse) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	handleLBHealth(tenants, w, httptest.NewRequest("GET", "/lb-health", nil))
+	var resp HealthResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	return w.Code, resp
+}
+
+func TestLBHealthFailsWhileDraining(t *testing.T) {
+	tenants := newTenantHub()
+	code, resp := lbHealth(t, tenants)
+	if code != http.StatusOK || resp.Status != "ok" || !resp.Accepting {
+		t.Errorf("before draining: %d %+v, want 200 ok and accepting", code, resp)
+	}
+
+	draining.Store(true)
+	defer draining.Store(false)
+	code, resp = lbHealth(t, tenants)
+	if code != http.StatusServiceUnavailable || resp.Status != "draining" || resp.Accepting {
+		t.Errorf("while draining: %d %+v, want 503 draining and not accepting", code, resp)
+	}
+}
+
+func TestLBHealthSessionAffinityKeyIsStable(t *testing.T) {
+	tenants := newTenantHub()
+	_, first := lbHealth(t, tenants)
+	if first.SessionAffinityKey == "" {
+		t.Fatal("session_affinity_key is empty")
+	}
+	for range 3 {
+		if _, resp := lbHealth(t, tenants); resp.SessionAffinityKey != first.SessionAffinityKey {
+			t.Errorf("session_affinity_key = %q, then %q", first.SessionAffinityKey, resp.SessionAffinityKey)
+		}
+	}
+}
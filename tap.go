@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// Time allowed to write an event to a tap observer.
+	tapWriteWait = 5 * time.Millisecond
+
+	// Number of events queued for a tap observer before it is disconnected.
+	tapBufferSize = 256
+)
+
+// TapEvent is a hub event mirrored to tap observers, one JSON object per
+// line.
+type TapEvent struct {
+	Timestamp int64  `json:"ts"`
+	Type      string `json:"type"`
+	TenantID  string `json:"tenant_id"`
+	Client    string `json:"client"`
+	Data      string `json:"data,omitempty"`
+}
+
+// Tap mirrors hub events to passive observers connected to a UNIX domain
+// socket. Observers that cannot keep up are disconnected rather than
+// slowing down the hubs.
+type Tap struct {
+	ln net.Listener
+
+	mu        sync.Mutex
+	observers map[*tapObserver]bool
+}
+
+type tapObserver struct {
+	conn   net.Conn
+	events chan []byte
+}
+
+// newTap listens on the UNIX domain socket at path, replacing a stale socket
+// left behind by a previous run.
+func newTap(path string) (*Tap, error) {
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	return &Tap{ln: ln, observers: make(map[*tapObserver]bool)}, nil
+}
+
+// run accepts observers until the tap is closed.
+func (t *Tap) run() {
+	for {
+		conn, err := t.ln.Accept()
+		if err != nil {
+			return
+		}
+		o := &tapObserver{conn: conn, events: make(chan []byte, tapBufferSize)}
+		t.mu.Lock()
+		t.observers[o] = true
+		t.mu.Unlock()
+		go t.write(o)
+	}
+}
+
+// write sends queued events to o until its queue is closed or a write fails.
+func (t *Tap) write(o *tapObserver) {
+	defer o.conn.Close()
+	for event := range o.events {
+		o.conn.SetWriteDeadline(time.Now().Add(tapWriteWait))
+		if _, err := o.conn.Write(event); err != nil {
+			log.Printf("Disconnecting tap observer: %v", err)
+			t.remove(o)
+			return
+		}
+	}
+}
+
+// remove stops sending events to o.
+func (t *Tap) remove(o *tapObserver) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.observers[o] {
+		delete(t.observers, o)
+		close(o.events)
+	}
+}
+
+// publish queues event for every observer without blocking. An observer
+// whose queue is full is disconnected. A nil tap does nothing.
+func (t *Tap) publish(event TapEvent) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.observers) == 0 {
+		return
+	}
+	event.Timestamp = time.Now().UnixMilli()
+	b, _ := json.Marshal(event)
+	b = append(b, '\n')
+	for o := range t.observers {
+		select {
+		case o.events <- b:
+		default:
+			log.Printf("Disconnecting tap observer with full buffer")
+			delete(t.observers, o)
+			close(o.events)
+			// Fail the writes of the events still queued rather than
+			// waiting for each of them to time out.
+			o.conn.Close()
+		}
+	}
+}
+
+// Close stops accepting observers, disconnects the connected ones and
+// removes the socket.
+func (t *Tap) Close() error {
+	err := t.ln.Close()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for o := range t.observers {
+		delete(t.observers, o)
+		close(o.events)
+	}
+	return err
+}
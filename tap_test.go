@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestTapMirrorsHubEvents(t *testing.T) {
+	tap, err := newTap(filepath.Join(t.TempDir(), "chat.tap"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tap.Close()
+	go tap.run()
+	observer, err := net.Dial("unix", tap.ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer observer.Close()
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		tap.mu.Lock()
+		n := len(tap.observers)
+		tap.mu.Unlock()
+		if n == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("observer not accepted")
+		}
+	}
+
+	srv, tenants := newTestServer(t)
+	tenants.tap = tap
+	a := dialTest(t, srv, newTestToken(t, "guest-a", "acme"))
+	b := dialTest(t, srv, newTestToken(t, "guest-b", "acme"))
+	if err := a.WriteMessage(websocket.TextMessage, []byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	readText(t, b)
+	b.Close()
+
+	want := []TapEvent{
+		{Type: "register", TenantID: "acme", Client: "guest-a"},
+		{Type: "register", TenantID: "acme", Client: "guest-b"},
+		{Type: "broadcast", TenantID: "acme", Client: "guest-a", Data: "guest-a: hi"},
+		{Type: "unregister", TenantID: "acme", Client: "guest-b"},
+	}
+	observer.SetReadDeadline(time.Now().Add(time.Second))
+	lines := bufio.NewScanner(observer)
+	for i, w := range want {
+		if !lines.Scan() {
+			t.Fatalf("event %d missing: %v", i, lines.Err())
+		}
+		var got TapEvent
+		if err := json.Unmarshal(lines.Bytes(), &got); err != nil {
+			t.Fatalf("event %d: %v", i, err)
+		}
+		if got.Timestamp == 0 {
+			t.Errorf("event %d has no timestamp", i)
+		}
+		got.Timestamp = 0
+		if got != w {
+			t.Errorf("event %d = %+v, want %+v", i, got, w)
+		}
+	}
+}
+
+func TestTapDisconnectsFullObserver(t *testing.T) {
+	tap := &Tap{observers: make(map[*tapObserver]bool)}
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	o := &tapObserver{conn: conn, events: make(chan []byte, 1)}
+	tap.observers[o] = true
+
+	tap.publish(TapEvent{Type: "broadcast"})
+	tap.publish(TapEvent{Type: "broadcast"})
+
+	if tap.observers[o] {
+		t.Error("observer with a full buffer not removed")
+	}
+	<-o.events
+	if _, ok := <-o.events; ok {
+		t.Error("events of the removed observer not closed")
+	}
+	conn.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err := conn.Write([]byte("x")); !errors.Is(err, io.ErrClosedPipe) {
+		t.Errorf("write to the removed observer = %v, want its connection closed", err)
+	}
+}
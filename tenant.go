@@ -0,0 +1,186 @@
+package main
+
+import (
+	"crypto/subtle"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Tenant IDs accepted by the token endpoint. The empty ID is the default
+// tenant.
+var tenantIDPattern = regexp.MustCompile(`^[a-zA-Z0-9_-]{0,64}$`)
+
+// canGrantTenant reports whether a token of tenantID may be issued to a
+// requester presenting secret. The default tenant is open to everyone; the
+// others need the tenant grant secret, so guests cannot join any tenant they
+// like.
+func canGrantTenant(tenantID, secret string) bool {
+	if tenantID == "" {
+		return true
+	}
+	if *tenantGrantSecret == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(secret), []byte(*tenantGrantSecret)) == 1
+}
+
+// TenantHub keeps a separate Hub for every tenant, so that clients of one
+// tenant never see messages or clients of another.
+type TenantHub struct {
+	mu   sync.Mutex
+	hubs map[string]*Hub
+
+	// Messages broadcast by hubs that have since been stopped, so that the
+	// total reported by stats never goes down.
+	stoppedMessages int64
+
+	// End of the mutes set through mute, keyed by tenant and guest name.
+	// Kept here rather than on the clients so that a muted guest cannot
+	// reconnect to lift the mute, even once its hub has been stopped.
+	mutes map[[2]string]time.Time
+
+	// Settings applied to every hub. Must be set before the first call to
+	// register.
+	echo             bool
+	heartbeatTimeout time.Duration
+	tap              *Tap
+}
+
+func newTenantHub() *TenantHub {
+	return &TenantHub{hubs: make(map[string]*Hub), mutes: make(map[[2]string]time.Time)}
+}
+
+// register connects client to the hub of the given tenant, starting the hub
+// on first use. A client whose name is muted in the tenant starts out muted.
+func (t *TenantHub) register(tenantID string, client *Client) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	h, ok := t.hubs[tenantID]
+	if !ok {
+		h = newHub()
+		h.echo = t.echo
+		h.heartbeatTimeout = t.heartbeatTimeout
+		h.tenantID = tenantID
+		h.tap = t.tap
+		t.hubs[tenantID] = h
+		go h.run()
+	}
+	h.refs++
+	client.hub = h
+	client.tenants = t
+	if until, ok := t.mutes[[2]string{tenantID, client.name}]; ok && time.Now().Before(until) {
+		client.mutedUntil = until
+		client.send <- []byte(mutedPrefix + strconv.FormatInt(until.Unix(), 10))
+	}
+	h.register <- client
+}
+
+// unregister disconnects client from its hub, and stops and forgets the hub
+// once its last client is gone, so idle tenants cost nothing.
+//
+// Hubs are only sent to with the lock held or by their registered clients,
+// so nothing can be sending to a hub once it is stopped.
+func (t *TenantHub) unregister(client *Client) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	h := client.hub
+	h.unregister <- client
+	if h.refs--; h.refs == 0 {
+		t.stoppedMessages += h.numMessages.Load()
+		delete(t.hubs, h.tenantID)
+		close(h.stop)
+	}
+}
+
+// revoke disconnects the clients of the given tenant that were authenticated
+// with the token jti.
+func (t *TenantHub) revoke(tenantID, jti string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if h, ok := t.hubs[tenantID]; ok {
+		h.revoke <- jti
+	}
+}
+
+// stats returns the number of connected clients and the number of messages
+// broadcast so far, summed over all tenants, and the number of tenants with
+// connected clients.
+func (t *TenantHub) stats() (clients, messages int64, tenants int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	messages = t.stoppedMessages
+	for _, h := range t.hubs {
+		clients += h.numClients.Load()
+		messages += h.numMessages.Load()
+	}
+	return clients, messages, len(t.hubs)
+}
+
+// mute mutes the clients named name in the given tenant until until, or
+// unmutes them if it is zero. It reports whether there were any. The mute
+// also applies to clients of that name connecting before it ends.
+func (t *TenantHub) mute(tenantID, name string, until time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	h, ok := t.hubs[tenantID]
+	if !ok {
+		return false
+	}
+	req := &muteRequest{name: name, until: until, found: make(chan bool, 1)}
+	h.mute <- req
+	if !<-req.found {
+		return false
+	}
+
+	now := time.Now()
+	for key, end := range t.mutes {
+		if now.After(end) {
+			delete(t.mutes, key)
+		}
+	}
+	if until.IsZero() {
+		delete(t.mutes, [2]string{tenantID, name})
+	} else {
+		t.mutes[[2]string{tenantID, name}] = until
+	}
+	return true
+}
+
+// closeAll disconnects the clients of every tenant with the given close code.
+func (t *TenantHub) closeAll(code int, text string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, h := range t.hubs {
+		h.closeAll <- websocket.FormatCloseMessage(code, text)
+	}
+}
+
+// clientsOf describes the connected clients of one tenant.
+func (t *TenantHub) clientsOf(tenantID string) []ClientInfo {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	h, ok := t.hubs[tenantID]
+	if !ok {
+		return nil
+	}
+	reply := make(chan []ClientInfo, 1)
+	h.list <- reply
+	infos := <-reply
+	for i := range infos {
+		infos[i].TenantID = tenantID
+	}
+	return infos
+}
+
+// announce sends data to every client of the given tenant.
+func (t *TenantHub) announce(tenantID string, data []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if h, ok := t.hubs[tenantID]; ok {
+		h.announce <- data
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestTenantHubStopsIdleHubs(t *testing.T) {
+	srv, tenants := newTestServer(t)
+	conn := dialTest(t, srv, newTestToken(t, "guest-a", "acme"))
+
+	tenants.mu.Lock()
+	h := tenants.hubs["acme"]
+	tenants.mu.Unlock()
+	if h == nil {
+		t.Fatal("no hub for a connected tenant")
+	}
+
+	conn.Close()
+	select {
+	case <-h.stop:
+	case <-time.After(time.Second):
+		t.Fatal("hub not stopped after its last client left")
+	}
+	tenants.mu.Lock()
+	defer tenants.mu.Unlock()
+	if _, ok := tenants.hubs["acme"]; ok {
+		t.Error("stopped hub still registered")
+	}
+}
+
+func TestTenantHubIsolatesTenants(t *testing.T) {
+	srv, _ := newTestServer(t)
+	a := dialTest(t, srv, newTestToken(t, "guest-a", "acme"))
+	b := dialTest(t, srv, newTestToken(t, "guest-b", "globex"))
+	c := dialTest(t, srv, newTestToken(t, "guest-c", "acme"))
+
+	if err := a.WriteMessage(websocket.TextMessage, []byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	if got := readText(t, c); got != "guest-a: hi" {
+		t.Errorf("same tenant got %q, want %q", got, "guest-a: hi")
+	}
+	b.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, message, err := b.ReadMessage(); err == nil {
+		t.Errorf("other tenant got %q", message)
+	}
+}
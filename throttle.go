@@ -0,0 +1,151 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How often idle windows and expired bans are removed.
+const throttlePruneInterval = time.Minute
+
+// ipThrottle limits how often a single IP address may do something, using a
+// sliding window of recent attempts. Optionally, an address that is turned
+// away banAfter times in a row is banned for banFor.
+type ipThrottle struct {
+	limit    int
+	window   time.Duration
+	banAfter int
+	banFor   time.Duration
+
+	// Maps IP to *slidingWindow.
+	windows sync.Map
+
+	// Maps IP to the time its ban ends.
+	bans sync.Map
+}
+
+// slidingWindow records the recent attempts of one IP address.
+type slidingWindow struct {
+	mu       sync.Mutex
+	attempts []time.Time
+
+	// Number of attempts rejected since the last allowed one.
+	rejected int
+}
+
+// newIPThrottle returns a throttle allowing limit attempts per window. A
+// banAfter of zero never bans.
+func newIPThrottle(limit int, window time.Duration, banAfter int, banFor time.Duration) *ipThrottle {
+	return &ipThrottle{limit: limit, window: window, banAfter: banAfter, banFor: banFor}
+}
+
+// allow records an attempt from ip and reports whether it may proceed. banned
+// is set if the attempt was refused because ip is banned.
+func (t *ipThrottle) allow(ip string) (ok, banned bool) {
+	now := time.Now()
+	if until, found := t.bans.Load(ip); found {
+		if now.Before(until.(time.Time)) {
+			return false, true
+		}
+		t.bans.Delete(ip)
+	}
+
+	v, _ := t.windows.LoadOrStore(ip, &slidingWindow{})
+	w := v.(*slidingWindow)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.prune(now.Add(-t.window))
+	w.attempts = append(w.attempts, now)
+	if len(w.attempts) > t.limit+1 {
+		// Remembering limit+1 attempts is enough to keep refusing, and
+		// keeps an address hammering away from growing its window.
+		w.attempts = w.attempts[len(w.attempts)-t.limit-1:]
+	}
+	if len(w.attempts) <= t.limit {
+		w.rejected = 0
+		return true, false
+	}
+
+	w.rejected++
+	if t.banAfter > 0 && w.rejected >= t.banAfter {
+		t.bans.Store(ip, now.Add(t.banFor))
+		w.rejected = 0
+	}
+	return false, false
+}
+
+// prune drops attempts made before cutoff. w.mu must be held.
+func (w *slidingWindow) prune(cutoff time.Time) {
+	i := 0
+	for i < len(w.attempts) && w.attempts[i].Before(cutoff) {
+		i++
+	}
+	w.attempts = w.attempts[i:]
+}
+
+// run periodically forgets idle addresses and expired bans.
+func (t *ipThrottle) run() {
+	ticker := time.NewTicker(throttlePruneInterval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		t.windows.Range(func(k, v any) bool {
+			w := v.(*slidingWindow)
+			w.mu.Lock()
+			w.prune(now.Add(-t.window))
+			idle := len(w.attempts) == 0
+			w.mu.Unlock()
+			if idle {
+				t.windows.Delete(k)
+			}
+			return true
+		})
+		t.bans.Range(func(k, v any) bool {
+			if now.After(v.(time.Time)) {
+				t.bans.Delete(k)
+			}
+			return true
+		})
+	}
+}
+
+// wrap rejects requests from addresses that exceed the throttle with 429 Too
+// Many Requests before passing the rest on to next.
+func (t *ipThrottle) wrap(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ip := clientIP(r)
+		if ok, banned := t.allow(ip); !ok {
+			if banned {
+				log.Printf("request_id=%s Rejected banned address %s", requestID(r.Context()), ip)
+			} else {
+				log.Printf("request_id=%s Rate limited address %s", requestID(r.Context()), ip)
+			}
+			http.Error(w, "Too many requests", http.StatusTooManyRequests)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// clientIP returns the IP address the request came from. With -trust-proxy,
+// that is the last address in X-Forwarded-For, which is the one the proxy in
+// front of the server saw.
+func clientIP(r *http.Request) string {
+	if *trustProxy {
+		if hops := r.Header.Values("X-Forwarded-For"); len(hops) > 0 {
+			addrs := strings.Split(hops[len(hops)-1], ",")
+			if ip := strings.TrimSpace(addrs[len(addrs)-1]); ip != "" {
+				return ip
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
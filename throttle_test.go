@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestIPThrottleRejectsThenBans(t *testing.T) {
+	throttle := newIPThrottle(10, time.Minute, 5, time.Hour)
+	for i := 1; i <= 10; i++ {
+		if ok, _ := throttle.allow("192.0.2.1"); !ok {
+			t.Fatalf("attempt %d rejected, want allowed", i)
+		}
+	}
+	for i := 11; i <= 15; i++ {
+		if ok, banned := throttle.allow("192.0.2.1"); ok || banned {
+			t.Fatalf("attempt %d = ok %v, banned %v, want rejected", i, ok, banned)
+		}
+	}
+	if ok, banned := throttle.allow("192.0.2.1"); ok || !banned {
+		t.Fatalf("attempt 16 = ok %v, banned %v, want banned", ok, banned)
+	}
+	if ok, _ := throttle.allow("192.0.2.2"); !ok {
+		t.Error("other address rejected")
+	}
+}
+
+func TestIPThrottleBoundsAttempts(t *testing.T) {
+	throttle := newIPThrottle(3, time.Minute, 0, 0)
+	for range 100 {
+		throttle.allow("192.0.2.1")
+	}
+	v, _ := throttle.windows.Load("192.0.2.1")
+	if n := len(v.(*slidingWindow).attempts); n != 4 {
+		t.Errorf("remembered %d attempts, want 4", n)
+	}
+}
+
+func TestClientIPTrustProxy(t *testing.T) {
+	r := httptest.NewRequest("GET", "/ws", nil)
+	r.RemoteAddr = "10.0.0.1:1234"
+	r.Header.Add("X-Forwarded-For", "198.51.100.9, 203.0.113.7")
+
+	if got := clientIP(r); got != "10.0.0.1" {
+		t.Errorf("without -trust-proxy clientIP = %q, want the connection's address", got)
+	}
+	*trustProxy = true
+	defer func() { *trustProxy = false }()
+	if got := clientIP(r); got != "203.0.113.7" {
+		t.Errorf("with -trust-proxy clientIP = %q, want the last forwarded address", got)
+	}
+}
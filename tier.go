@@ -0,0 +1,89 @@
+package main
+
+import (
+	"crypto/subtle"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// The tier given to clients whose token names no known tier.
+const defaultTier = "free"
+
+// RateLimitConfig limits what a client of a tier may send.
+type RateLimitConfig struct {
+	// Sustained number of messages per second.
+	MessagesPerSec float64
+
+	// Number of messages that may be sent in a burst above the rate.
+	Burst int
+
+	// Maximum length of a message in bytes. Capped by maxMessageSize.
+	MaxMessageLength int
+
+	// Split longer messages into up to maxSplitParts parts instead of
+	// rejecting them. Messages that need more parts are still rejected.
+	SplitLongMessages bool
+}
+
+// Maximum number of parts a long message is split into. Also bounds the read
+// limit of tiers that split messages, to maxSplitParts times their
+// MaxMessageLength.
+const maxSplitParts = 4
+
+// Limits of each tier. The keys are the tiers the token endpoint will issue.
+var tierLimits = map[string]RateLimitConfig{
+	"free":       {MessagesPerSec: 10, Burst: 20, MaxMessageLength: 256},
+	"pro":        {MessagesPerSec: 50, Burst: 100, MaxMessageLength: maxMessageSize, SplitLongMessages: true},
+	"enterprise": {MessagesPerSec: 200, Burst: 400, MaxMessageLength: maxMessageSize, SplitLongMessages: true},
+}
+
+// effectiveTier returns tier if it is known and the default tier otherwise.
+func effectiveTier(tier string) string {
+	if _, ok := tierLimits[tier]; ok {
+		return tier
+	}
+	return defaultTier
+}
+
+// limitsFor returns the limits of tier, falling back to the default tier.
+func limitsFor(tier string) RateLimitConfig {
+	return tierLimits[effectiveTier(tier)]
+}
+
+// canGrantTier reports whether a token of tier may be issued to a requester
+// presenting secret. The default tier is open to everyone; the others need
+// the tier grant secret, so guests cannot promote themselves.
+func canGrantTier(tier, secret string) bool {
+	if tier == defaultTier {
+		return true
+	}
+	if _, ok := tierLimits[tier]; !ok || *tierGrantSecret == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(secret), []byte(*tierGrantSecret)) == 1
+}
+
+// splitMessage splits text into parts of at most max bytes. Parts end at the
+// last whitespace that fits, or at a rune boundary for words longer than
+// max, and the whitespace between parts is dropped.
+func splitMessage(text string, max int) []string {
+	var parts []string
+	for len(text) > max {
+		cut := 0
+		for i, r := range text {
+			if i+utf8.RuneLen(r) > max {
+				if cut == 0 {
+					cut = i
+				}
+				break
+			}
+			if unicode.IsSpace(r) {
+				cut = i
+			}
+		}
+		parts = append(parts, strings.TrimRightFunc(text[:cut], unicode.IsSpace))
+		text = strings.TrimLeftFunc(text[cut:], unicode.IsSpace)
+	}
+	return append(parts, text)
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestSplitMessage(t *testing.T) {
+	tests := []struct {
+		text string
+		max  int
+		want []string
+	}{
+		{"short", 10, []string{"short"}},
+		{"exactly10!", 10, []string{"exactly10!"}},
+		{"hello world", 10, []string{"hello", "world"}},
+		{"hello     world", 10, []string{"hello", "world"}},
+		{"abcdefghijklmno", 10, []string{"abcdefghij", "klmno"}},
+		{"one two three four", 9, []string{"one two", "three", "four"}},
+		// Never cut inside a rune: é is two bytes.
+		{"ééééééé", 5, []string{"éé", "éé", "éé", "é"}},
+		{"aéééé", 4, []string{"aé", "éé", "é"}},
+	}
+	for _, tt := range tests {
+		got := splitMessage(tt.text, tt.max)
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("splitMessage(%q, %d) = %q, want %q", tt.text, tt.max, got, tt.want)
+		}
+		for _, part := range got {
+			if len(part) > tt.max {
+				t.Errorf("splitMessage(%q, %d): part %q longer than %d", tt.text, tt.max, part, tt.max)
+			}
+		}
+	}
+}
+
+func TestSplitMessageKeepsText(t *testing.T) {
+	text := strings.TrimSpace(strings.Repeat("lorem ipsum dolor ", 50))
+	parts := splitMessage(text, 64)
+	if got, want := strings.Join(parts, " "), text; got != want {
+		t.Errorf("joined parts differ from the message:\n got %q\nwant %q", got, want)
+	}
+}
+
+// dialTier connects a client of the given tier.
+func dialTier(t *testing.T, srv *httptest.Server, name, tier string) *websocket.Conn {
+	t.Helper()
+	token, _, err := generateGuestToken(name, "", tier)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dialTest(t, srv, token)
+}
+
+func TestLongMessagesSplitSharingThreadID(t *testing.T) {
+	srv, _ := newTestServer(t)
+	sender := dialTier(t, srv, "guest-a", "pro")
+	peer := dialTest(t, srv, newTestToken(t, "guest-b", ""))
+
+	text := strings.TrimSpace(strings.Repeat("lorem ipsum dolor ", 70))
+	if err := sender.WriteMessage(websocket.TextMessage, []byte(text)); err != nil {
+		t.Fatal(err)
+	}
+	want := splitMessage(text, maxMessageSize)
+	if len(want) != 3 {
+		t.Fatalf("test message splits into %d parts, want 3", len(want))
+	}
+	var threadID string
+	for i, part := range want {
+		got := readText(t, peer)
+		var n, of int
+		var id string
+		prefix, body, _ := strings.Cut(got, "] ")
+		if _, err := fmt.Sscanf(prefix, "guest-a: [%d/%d %s", &n, &of, &id); err != nil {
+			t.Fatalf("part %d = %q: %v", i, got, err)
+		}
+		if n != i+1 || of != len(want) || body != part {
+			t.Errorf("part %d = %q, want [%d/%d ...] %q", i, got, i+1, len(want), part)
+		}
+		if threadID == "" {
+			threadID = id
+		} else if id != threadID {
+			t.Errorf("part %d has thread ID %q, want %q", i, id, threadID)
+		}
+	}
+}
+
+func TestLongMessagesRejected(t *testing.T) {
+	srv, _ := newTestServer(t)
+	free := dialTest(t, srv, newTestToken(t, "guest-a", ""))
+	if reply := chatReply(t, free, strings.Repeat("a", tierLimits["free"].MaxMessageLength+1)); reply != errorPrefix+"message_too_long" {
+		t.Errorf("free tier reply = %q, want %smessage_too_long", reply, errorPrefix)
+	}
+
+	// Six words of 300 bytes fit the read limit but take six parts.
+	pro := dialTier(t, srv, "guest-b", "pro")
+	words := strings.TrimSpace(strings.Repeat(strings.Repeat("b", 300)+" ", 6))
+	if reply := chatReply(t, pro, words); reply != errorPrefix+"message_too_long" {
+		t.Errorf("reply to a message of %d parts = %q, want %smessage_too_long", len(splitMessage(words, maxMessageSize)), reply, errorPrefix)
+	}
+}
+
+func TestTierLimits(t *testing.T) {
+	srv, tenants := newTestServer(t)
+	tenants.echo = true
+	n := tierLimits["free"].Burst + 5
+	for _, tt := range []struct {
+		tier        string
+		rateLimited bool
+	}{
+		{"free", true},
+		{"pro", false},
+	} {
+		conn := dialTier(t, srv, "guest-"+tt.tier, tt.tier)
+		for range n {
+			if err := conn.WriteMessage(websocket.TextMessage, []byte("hi")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		echoed, limited := 0, 0
+		for range n {
+			switch got := readText(t, conn); got {
+			case echoPrefix + "guest-" + tt.tier + ": hi":
+				echoed++
+			case errorPrefix + "rate_limited":
+				limited++
+			default:
+				t.Fatalf("%s tier got %q", tt.tier, got)
+			}
+		}
+		if tt.rateLimited && (limited == 0 || echoed < tierLimits[tt.tier].Burst) {
+			t.Errorf("%s tier: %d echoed, %d rate limited, want a burst of %d then rate limited", tt.tier, echoed, limited, tierLimits[tt.tier].Burst)
+		}
+		if !tt.rateLimited && limited != 0 {
+			t.Errorf("%s tier: %d of %d messages rate limited, want none", tt.tier, limited, n)
+		}
+
+		long := strings.Repeat("a", tierLimits["free"].MaxMessageLength+1)
+		got := chatReply(t, conn, long)
+		if tooLong := got == errorPrefix+"message_too_long"; tooLong != (tt.tier == "free") {
+			t.Errorf("%s tier reply to %d bytes = %q", tt.tier, len(long), got)
+		}
+	}
+}
+
+func TestCanGrantTier(t *testing.T) {
+	defer func(secret string) { *tierGrantSecret = secret }(*tierGrantSecret)
+
+	*tierGrantSecret = ""
+	if !canGrantTier(defaultTier, "") {
+		t.Error("default tier refused")
+	}
+	if canGrantTier("pro", "") {
+		t.Error("pro granted without a tier grant secret configured")
+	}
+
+	*tierGrantSecret = "s3cret"
+	tests := []struct {
+		tier, secret string
+		want         bool
+	}{
+		{defaultTier, "", true},
+		{"pro", "", false},
+		{"pro", "wrong", false},
+		{"pro", "s3cret", true},
+		{"enterprise", "s3cret", true},
+		{"platinum", "s3cret", false},
+	}
+	for _, tt := range tests {
+		if got := canGrantTier(tt.tier, tt.secret); got != tt.want {
+			t.Errorf("canGrantTier(%q, %q) = %v, want %v", tt.tier, tt.secret, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"slices"
+	"time"
+)
+
+// ClaimsValidator checks the claims of a token after its signature has been
+// verified, for validation logic that differs between deployments. Validate
+// should return an *AuthError so the caller can report a specific code.
+type ClaimsValidator interface {
+	Validate(claims *Claims) error
+}
+
+// Validator applied by validateToken unless overridden with
+// WithClaimsValidator. Set in main.
+var claimsValidator ClaimsValidator = NoOpValidator{}
+
+// ValidateOption changes how validateToken validates a token.
+type ValidateOption func(*validateOptions)
+
+type validateOptions struct {
+	validator ClaimsValidator
+}
+
+// WithClaimsValidator has validateToken check claims with v instead of the
+// server-wide validator.
+func WithClaimsValidator(v ClaimsValidator) ValidateOption {
+	return func(o *validateOptions) { o.validator = v }
+}
+
+// NoOpValidator accepts all claims.
+type NoOpValidator struct{}
+
+func (NoOpValidator) Validate(*Claims) error { return nil }
+
+// ExpiryValidator rejects tokens without an expiry time. The JWT parser
+// already rejects expired tokens, but accepts tokens lacking the exp claim.
+type ExpiryValidator struct{}
+
+func (ExpiryValidator) Validate(claims *Claims) error {
+	if claims.ExpiresAt == nil || !claims.ExpiresAt.After(time.Now()) {
+		return &AuthError{Code: authInvalidToken, Message: "token has no valid expiry"}
+	}
+	return nil
+}
+
+// TenantValidator accepts only tokens of the given tenants.
+type TenantValidator struct {
+	allowedTenants []string
+}
+
+func (v TenantValidator) Validate(claims *Claims) error {
+	if !slices.Contains(v.allowedTenants, claims.TenantID) {
+		return &AuthError{Code: authTenantNotAllowed, Message: "tenant " + claims.TenantID + " is not allowed"}
+	}
+	return nil
+}
+
+// ValidatorChain runs validators in order and returns the first error.
+type ValidatorChain []ClaimsValidator
+
+func (c ValidatorChain) Validate(claims *Claims) error {
+	for _, v := range c {
+		if err := v.Validate(claims); err != nil {
+			return err
+		}
+	}
+	return nil
+}
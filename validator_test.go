@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/websocket"
+)
+
+// nameValidator rejects the guest named banned, with a plain error.
+type nameValidator struct{ banned string }
+
+func (v nameValidator) Validate(claims *Claims) error {
+	if claims.GuestName == v.banned {
+		return errors.New("guest is banned")
+	}
+	return nil
+}
+
+func TestClaimsValidatorRejectsUpgrade(t *testing.T) {
+	claimsValidator = nameValidator{banned: "guest-bad"}
+	defer func() { claimsValidator = NoOpValidator{} }()
+	srv, _ := newTestServer(t)
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws?token="
+
+	_, resp, err := websocket.DefaultDialer.Dial(url+newTestToken(t, "guest-bad", ""), nil)
+	if err == nil {
+		t.Fatal("upgrade with a rejected guest name succeeded")
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusUnauthorized || !strings.Contains(string(body), "claims rejected") {
+		t.Errorf("response = %d %q, want %d with claims rejected", resp.StatusCode, body, http.StatusUnauthorized)
+	}
+
+	dialTest(t, srv, newTestToken(t, "guest-good", ""))
+}
+
+func TestValidateTokenValidators(t *testing.T) {
+	signed := func(claims *Claims) string {
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(jwtSecret)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	acme := newTestToken(t, "guest-a", "acme")
+	noExp := signed(&Claims{GuestName: "guest-b"})
+
+	tests := []struct {
+		name      string
+		token     string
+		validator ClaimsValidator
+		code      string
+	}{
+		{"no-op accepts", acme, NoOpValidator{}, ""},
+		{"custom error is wrapped", acme, nameValidator{banned: "guest-a"}, authClaimsRejected},
+		{"allowed tenant", acme, TenantValidator{allowedTenants: []string{"acme"}}, ""},
+		{"other tenant", acme, TenantValidator{allowedTenants: []string{"globex"}}, authTenantNotAllowed},
+		{"expiry present", acme, ExpiryValidator{}, ""},
+		{"expiry missing", noExp, ExpiryValidator{}, authInvalidToken},
+		{"chain stops at first error", noExp, ValidatorChain{TenantValidator{allowedTenants: []string{""}}, ExpiryValidator{}, nameValidator{banned: "guest-b"}}, authInvalidToken},
+	}
+	for _, tt := range tests {
+		_, err := validateToken(tt.token, WithClaimsValidator(tt.validator))
+		var authErr *AuthError
+		switch {
+		case tt.code == "" && err != nil:
+			t.Errorf("%s: error = %v, want none", tt.name, err)
+		case tt.code != "" && (!errors.As(err, &authErr) || authErr.Code != tt.code):
+			t.Errorf("%s: error = %v, want code %s", tt.name, err, tt.code)
+		}
+	}
+
+	// Expired tokens never reach the validators.
+	expired := signed(&Claims{RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(time.Now().Add(-time.Minute))}})
+	if _, err := validateToken(expired, WithClaimsValidator(NoOpValidator{})); err == nil {
+		t.Error("expired token accepted")
+	}
+}
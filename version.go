@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"strings"
+)
+
+// ProtocolVersion is the semantic version of the chat protocol spoken on /ws
+// and the HTTP API. Bump the minor version for backwards compatible additions
+// and the major version for changes that break existing clients.
+const ProtocolVersion = "1.3.0"
+
+const protocolVersionHeader = "X-Chat-Protocol-Version"
+
+// Version of the server binary, set at build time with
+// -ldflags "-X main.version=1.0.0".
+var version = "dev"
+
+// VersionInfo is the response of /api/version.
+type VersionInfo struct {
+	Protocol  string `json:"protocol"`
+	Server    string `json:"server"`
+	GoVersion string `json:"go_version"`
+}
+
+// ProtocolVersionMiddleware advertises ProtocolVersion on API responses.
+// WebSocket upgrades bypass the response writer's headers, so the upgrade
+// handlers set it themselves.
+func ProtocolVersionMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/api/") {
+			w.Header().Set(protocolVersionHeader, ProtocolVersion)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handleVersion reports the protocol and server versions.
+func handleVersion(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(VersionInfo{
+		Protocol:  ProtocolVersion,
+		Server:    version,
+		GoVersion: runtime.Version(),
+	})
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+var semverPattern = regexp.MustCompile(`^(0|[1-9][0-9]*)\.(0|[1-9][0-9]*)\.(0|[1-9][0-9]*)$`)
+
+func TestProtocolVersionHeader(t *testing.T) {
+	tenants := newTenantHub()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/version", handleVersion)
+	mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+		serveWs(tenants, w, r)
+	})
+	srv := httptest.NewServer(ProtocolVersionMiddleware(mux))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/api/version")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got := resp.Header.Get(protocolVersionHeader); got != ProtocolVersion {
+		t.Errorf("API response %s = %q, want %q", protocolVersionHeader, got, ProtocolVersion)
+	}
+
+	token := newTestToken(t, "alice", "")
+	conn, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws?token="+token, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if got := resp.Header.Get(protocolVersionHeader); got != ProtocolVersion {
+		t.Errorf("upgrade response %s = %q, want %q", protocolVersionHeader, got, ProtocolVersion)
+	}
+}
+
+func TestHandleVersion(t *testing.T) {
+	defer func(v string) { version = v }(version)
+	version = "1.4.2"
+
+	w := httptest.NewRecorder()
+	handleVersion(w, httptest.NewRequest("GET", "/api/version", nil))
+	var info VersionInfo
+	if err := json.NewDecoder(w.Body).Decode(&info); err != nil {
+		t.Fatal(err)
+	}
+	if !semverPattern.MatchString(info.Protocol) {
+		t.Errorf("protocol = %q, want a semantic version", info.Protocol)
+	}
+	if info.Server != version || !semverPattern.MatchString(info.Server) {
+		t.Errorf("server = %q, want %q", info.Server, version)
+	}
+	if info.GoVersion == "" {
+		t.Error("go_version is empty")
+	}
+}